@@ -2,6 +2,7 @@ package agent
 
 import (
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/loggo"
@@ -13,25 +14,36 @@ import (
 type Agent struct {
 	conf     *Config
 	bridge   *Bridge
+	auth     *authorizer
 	memstats *runtime.MemStats
 	metrics  *MetricService
-	eventCh  chan statusEvent
+	eventCh  chan bridgeEvent
+	logs     *logControl
 	log      loggo.Logger
 }
 
 func createAgent(conf *Config) *Agent {
-	return &Agent{
+	agent := &Agent{
 		conf:     conf,
 		bridge:   createBridge(conf),
+		auth:     createAuthorizer(conf),
 		memstats: &runtime.MemStats{},
 		metrics:  CreateMetricService(),
+		eventCh:  make(chan bridgeEvent, 10),
+		logs:     createLogControl(mqttTrace),
 		log:      loggo.GetLogger("agent"),
 	}
+	agent.bridge.eventCh = agent.eventCh
+	return agent
 }
 
 // TODO load the existing configuration on startup and start the bridge if needed
 func (a *Agent) start() error {
 
+	if a.auth.isOpen() {
+		a.log.Warningf("Control requests are not authenticated, any local client can configure the bridge")
+	}
+
 	return nil
 }
 
@@ -41,10 +53,45 @@ func (a *Agent) stop() error {
 	return nil
 }
 
+// checks the request may be acted on, rejections are audited
+func (a *Agent) authorize(topic string, req controlRequest) error {
+	return a.auth.authorize(topic, req)
+}
+
 func (a *Agent) startBridge(connect *connectRequest) error {
 	return a.bridge.start(connect.Url, connect.Token)
 }
 
+func (a *Agent) reconfigureBridge(reconfigure *reconfigureRequest) error {
+	return a.bridge.reconfigure(reconfigure.Url, reconfigure.Token)
+}
+
+// adds a key, makes one current or removes one, in that order
+func (a *Agent) updateKeys(req *keysRequest) error {
+
+	if req.KeyId != "" {
+		var err error
+		if req.Key != "" {
+			err = a.bridge.keys.addEncoded(req.KeyId, req.Key, req.Current)
+		} else {
+			err = a.bridge.keys.use(req.KeyId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if req.Remove != "" {
+		a.bridge.keys.remove(req.Remove)
+	}
+
+	return nil
+}
+
+func (a *Agent) setLogLevels(req *logRequest) error {
+	return a.logs.apply(req)
+}
+
 // save the state of the bridge then disconnect it
 func (a *Agent) stopBridge(disconnect *disconnectRequest) error {
 	return a.bridge.stop()
@@ -54,27 +101,78 @@ func (a *Agent) getMetrics() *metricsEvent {
 	return a.metrics.buildMetricsRequest()
 }
 
-func (a *Agent) getStatus() statsEvent {
+func (a *Agent) getReport(id string) *statusReport {
+
+	local, cloud := a.bridge.legsConnected()
 
-	var lastError string
+	return &statusReport{
+		Id:         id,
+		statsEvent: a.getStatus(),
 
-	if a.bridge.LastError != nil {
-		lastError = a.bridge.LastError.Error()
+		LocalConnected: local,
+		CloudConnected: cloud,
+		Endpoint:       a.bridge.endpoint(),
+
+		LocalRules: a.bridge.ruleStats("local"),
+		CloudRules: a.bridge.ruleStats("cloud"),
 	}
+}
+
+func (a *Agent) getStatus() statsEvent {
+
+	flags := a.bridge.flags()
+	lastError := logRedactor.redactError(flags.LastError)
+	probes := a.bridge.probeStats()
 
 	runtime.ReadMemStats(a.memstats)
 
+	// read once so the ratio agrees with the sizes reported
+	compressedRaw := atomic.LoadInt64(&a.bridge.CompressedRawBytes)
+	compressed := atomic.LoadInt64(&a.bridge.CompressedBytes)
+
 	return statsEvent{
 		LastError:      lastError,
 		Alloc:          a.memstats.Alloc,
 		HeapAlloc:      a.memstats.HeapAlloc,
 		TotalAlloc:     a.memstats.TotalAlloc,
 		Connected:      a.bridge.IsConnected(),
-		Configured:     a.bridge.Configured,
+		Configured:     flags.Configured,
 		Timestamp:      time.Now().Unix(),
-		IngressCounter: a.bridge.IngressCounter,
-		IngressBytes:   a.bridge.IngressBytes,
-		EgressCounter:  a.bridge.EgressCounter,
-		EgressBytes:    a.bridge.EgressBytes,
+		IngressCounter: atomic.LoadInt64(&a.bridge.IngressCounter),
+		IngressBytes:   atomic.LoadInt64(&a.bridge.IngressBytes),
+		EgressCounter:  atomic.LoadInt64(&a.bridge.EgressCounter),
+		EgressBytes:    atomic.LoadInt64(&a.bridge.EgressBytes),
+
+		CredentialsRequired: flags.CredentialsRequired,
+		RejectedCounter:     a.auth.Rejected,
+		FilteredCounter:     atomic.LoadInt64(&a.bridge.FilteredCounter),
+		RateLimitedCounter:  atomic.LoadInt64(&a.bridge.RateLimitedCounter),
+		SampledCounter:      atomic.LoadInt64(&a.bridge.SampledCounter),
+
+		CompressedRawBytes: compressedRaw,
+		CompressedBytes:    compressed,
+		CompressionRatio:   compressionRatio(compressedRaw, compressed),
+
+		BatchCounter:   atomic.LoadInt64(&a.bridge.BatchCounter),
+		UnbatchCounter: atomic.LoadInt64(&a.bridge.UnbatchCounter),
+
+		EncryptFailures: atomic.LoadInt64(&a.bridge.EncryptFailures),
+		DecryptFailures: atomic.LoadInt64(&a.bridge.DecryptFailures),
+
+		DuplicateCounter: atomic.LoadInt64(&a.bridge.DuplicateCounter),
+
+		ProbeSent:       probes.Sent,
+		ProbeLost:       probes.Lost,
+		ProbeLatencyP50: probes.P50,
+		ProbeLatencyP90: probes.P90,
+		ProbeLatencyP99: probes.P99,
+	}
+}
+
+// compressed size as a fraction of the original, 1 when nothing was compressed
+func compressionRatio(raw int64, compressed int64) float64 {
+	if raw == 0 {
+		return 1
 	}
+	return float64(compressed) / float64(raw)
 }
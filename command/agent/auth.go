@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// how far a signed request's timestamp may drift from our clock
+const maxRequestSkew = 5 * time.Minute
+
+var ErrUnsigned = errors.New("Unauthorized: request is not signed")
+var ErrBadSignature = errors.New("Unauthorized: bad signature")
+var ErrStaleRequest = errors.New("Unauthorized: request timestamp out of range")
+var ErrReplayedRequest = errors.New("Unauthorized: request already seen")
+var ErrHostNotAllowed = errors.New("Unauthorized: cloud host not allowed")
+
+// Optional proof that a control request came from a holder of the shared secret.
+type requestAuth struct {
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// Implemented by every request arriving on the control topics.
+type controlRequest interface {
+	requestId() string
+	credentials() requestAuth
+	// values covered by the signature, in order
+	signedFields() []string
+	// cloud url the request points the bridge at, if any
+	destination() string
+}
+
+func (r *connectRequest) requestId() string        { return r.Id }
+func (r *connectRequest) credentials() requestAuth { return r.requestAuth }
+func (r *connectRequest) signedFields() []string   { return []string{r.Url, r.Token} }
+func (r *connectRequest) destination() string      { return r.Url }
+
+func (r *reconfigureRequest) requestId() string        { return r.Id }
+func (r *reconfigureRequest) credentials() requestAuth { return r.requestAuth }
+func (r *reconfigureRequest) signedFields() []string   { return []string{r.Url, r.Token} }
+func (r *reconfigureRequest) destination() string      { return r.Url }
+
+func (r *disconnectRequest) requestId() string        { return r.Id }
+func (r *disconnectRequest) credentials() requestAuth { return r.requestAuth }
+func (r *disconnectRequest) signedFields() []string   { return []string{} }
+func (r *disconnectRequest) destination() string      { return "" }
+
+func (r *keysRequest) requestId() string        { return r.Id }
+func (r *keysRequest) credentials() requestAuth { return r.requestAuth }
+func (r *keysRequest) signedFields() []string {
+	return []string{r.KeyId, r.Key, strconv.FormatBool(r.Current), r.Remove}
+}
+func (r *keysRequest) destination() string { return "" }
+
+func (r *logRequest) requestId() string        { return r.Id }
+func (r *logRequest) credentials() requestAuth { return r.requestAuth }
+func (r *logRequest) signedFields() []string {
+	return []string{r.sortedLevels(), r.traceField(), strconv.Itoa(r.Revert)}
+}
+func (r *logRequest) destination() string { return "" }
+
+//
+// Decides who may drive the bridge over the control bus. Requests can be required
+// to carry an HMAC-SHA256 signature made with a shared secret, and the cloud hosts
+// they point at can be restricted to an allow-list of patterns. With neither
+// configured every request is accepted. All decisions end up in the audit log.
+//
+type authorizer struct {
+	secret       []byte
+	allowedHosts []string
+	seen         map[string]time.Time
+	log          loggo.Logger
+
+	Rejected int64
+
+	lock sync.Mutex
+}
+
+func createAuthorizer(conf *Config) *authorizer {
+
+	a := &authorizer{seen: make(map[string]time.Time), log: loggo.GetLogger("audit")}
+
+	if conf.ControlSecret != "" {
+		a.secret = []byte(conf.ControlSecret)
+	}
+
+	for _, host := range strings.Split(conf.AllowedHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			a.allowedHosts = append(a.allowedHosts, strings.ToLower(host))
+		}
+	}
+
+	return a
+}
+
+func (a *authorizer) isOpen() bool {
+	return a.secret == nil && len(a.allowedHosts) == 0
+}
+
+func (a *authorizer) authorize(topic string, req controlRequest) error {
+
+	err := a.check(topic, req, time.Now())
+
+	if err != nil {
+		a.lock.Lock()
+		a.Rejected++
+		a.lock.Unlock()
+
+		a.log.Warningf("rejected %s id=%s destination=%s: %s", topic, req.requestId(), logRedactor.redact(req.destination()), err)
+		return err
+	}
+
+	a.log.Infof("accepted %s id=%s destination=%s", topic, req.requestId(), logRedactor.redact(req.destination()))
+	return nil
+}
+
+func (a *authorizer) check(topic string, req controlRequest, now time.Time) error {
+
+	if a.secret != nil {
+		if err := a.checkSignature(topic, req, now); err != nil {
+			return err
+		}
+	}
+
+	if len(a.allowedHosts) > 0 && req.destination() != "" {
+		if !a.hostAllowed(req.destination()) {
+			return ErrHostNotAllowed
+		}
+	}
+
+	return nil
+}
+
+func (a *authorizer) checkSignature(topic string, req controlRequest, now time.Time) error {
+
+	auth := req.credentials()
+
+	if auth.Signature == "" {
+		return ErrUnsigned
+	}
+
+	sent := time.Unix(auth.Timestamp, 0)
+
+	if sent.Before(now.Add(-maxRequestSkew)) || sent.After(now.Add(maxRequestSkew)) {
+		return ErrStaleRequest
+	}
+
+	expected := signRequest(a.secret, topic, req.requestId(), auth.Timestamp, req.signedFields()...)
+
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(auth.Signature))) {
+		return ErrBadSignature
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// anything older than the skew window would be rejected as stale anyway
+	for signature, at := range a.seen {
+		if at.Before(now.Add(-2 * maxRequestSkew)) {
+			delete(a.seen, signature)
+		}
+	}
+
+	if _, ok := a.seen[expected]; ok {
+		return ErrReplayedRequest
+	}
+
+	a.seen[expected] = now
+
+	return nil
+}
+
+func (a *authorizer) hostAllowed(cloudUrl string) bool {
+
+	u, err := url.Parse(cloudUrl)
+
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	host := strings.ToLower(u.Host)
+
+	// patterns may or may not include a port
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+
+	for _, pattern := range a.allowedHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, strings.ToLower(u.Host)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Signs the topic, id, timestamp and request specific fields, each separated by
+// a newline, returning the hex encoded HMAC-SHA256.
+func signRequest(secret []byte, topic string, id string, timestamp int64, fields ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join(append([]string{topic, id, strconv.FormatInt(timestamp, 10)}, fields...), "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
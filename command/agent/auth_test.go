@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadAuthSuite struct {
+	secret []byte
+	auth   *authorizer
+	now    time.Time
+}
+
+var _ = Suite(&LoadAuthSuite{})
+
+func (s *LoadAuthSuite) SetUpTest(c *C) {
+	s.secret = []byte("shared-secret")
+	s.auth = createAuthorizer(&Config{ControlSecret: "shared-secret", AllowedHosts: "*.ninjasphere.co, localhost:1883"})
+	s.now = time.Unix(1412345678, 0)
+}
+
+func (s *LoadAuthSuite) signed(topic string, req *connectRequest) *connectRequest {
+	req.Timestamp = s.now.Unix()
+	req.Signature = signRequest(s.secret, topic, req.Id, req.Timestamp, req.Url, req.Token)
+	return req
+}
+
+func (s *LoadAuthSuite) TestOpen(c *C) {
+	auth := createAuthorizer(&Config{})
+	c.Assert(auth.isOpen(), Equals, true)
+	c.Assert(auth.check(connectTopic, &connectRequest{Url: "ssl://evil.example.com:8883"}, s.now), IsNil)
+}
+
+func (s *LoadAuthSuite) TestSignature(c *C) {
+
+	req := s.signed(connectTopic, &connectRequest{Id: "1", Url: "ssl://dev.ninjasphere.co:8883", Token: "abc"})
+	c.Assert(s.auth.check(connectTopic, req, s.now), IsNil)
+
+	// each signature is only good once
+	c.Assert(s.auth.check(connectTopic, req, s.now), Equals, ErrReplayedRequest)
+
+	// nor is it good for another topic
+	req = s.signed(connectTopic, &connectRequest{Id: "2", Url: "ssl://dev.ninjasphere.co:8883", Token: "abc"})
+	c.Assert(s.auth.check(reconfigureTopic, req, s.now), Equals, ErrBadSignature)
+
+	// or with a swapped token
+	req = s.signed(connectTopic, &connectRequest{Id: "3", Url: "ssl://dev.ninjasphere.co:8883", Token: "abc"})
+	req.Token = "def"
+	c.Assert(s.auth.check(connectTopic, req, s.now), Equals, ErrBadSignature)
+}
+
+func (s *LoadAuthSuite) TestUnsignedAndStale(c *C) {
+
+	c.Assert(s.auth.check(disconnectTopic, &disconnectRequest{Id: "1"}, s.now), Equals, ErrUnsigned)
+
+	req := s.signed(connectTopic, &connectRequest{Id: "1", Url: "ssl://dev.ninjasphere.co:8883"})
+	c.Assert(s.auth.check(connectTopic, req, s.now.Add(10*time.Minute)), Equals, ErrStaleRequest)
+}
+
+func (s *LoadAuthSuite) TestAllowedHosts(c *C) {
+
+	auth := createAuthorizer(&Config{AllowedHosts: "*.ninjasphere.co, localhost:1883"})
+
+	c.Assert(auth.check(connectTopic, &connectRequest{Url: "ssl://dev.ninjasphere.co:8883"}, s.now), IsNil)
+	c.Assert(auth.check(connectTopic, &connectRequest{Url: "tcp://localhost:1883"}, s.now), IsNil)
+	c.Assert(auth.check(connectTopic, &connectRequest{Url: "tcp://localhost:1884"}, s.now), Equals, ErrHostNotAllowed)
+	c.Assert(auth.check(connectTopic, &connectRequest{Url: "ssl://ninjasphere.co.evil.com:8883"}, s.now), Equals, ErrHostNotAllowed)
+	c.Assert(auth.check(connectTopic, &connectRequest{Url: "not a url"}, s.now), Equals, ErrHostNotAllowed)
+
+	// token only reconfigures keep the current host
+	c.Assert(auth.check(reconfigureTopic, &reconfigureRequest{Token: "abc"}, s.now), IsNil)
+}
+
+func (s *LoadAuthSuite) TestRejectedCounter(c *C) {
+	c.Assert(s.auth.authorize(disconnectTopic, &disconnectRequest{Id: "1"}), NotNil)
+	c.Assert(s.auth.Rejected, Equals, int64(1))
+}
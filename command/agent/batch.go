@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//
+// Collects the messages of a local rule and publishes them together as a single
+// envelope on Topic, once Delay ms have passed since the first message or they
+// add up to Size bytes. A batch never goes over Size unless a single message does.
+//
+type batcher struct {
+	Topic string `json:"topic"`
+	Delay int    `json:"delay"`
+	Size  int    `json:"size,omitempty"`
+
+	pending *batchEnvelope
+	bytes   int
+	timer   *time.Timer
+	lock    sync.Mutex
+}
+
+// JSON payloads are embedded as is, anything else is base64 encoded in data.
+type batchEntry struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+}
+
+type batchEnvelope struct {
+	Batch []batchEntry `json:"$batch"`
+}
+
+func (b *batcher) compile() error {
+
+	if b.Topic == "" {
+		return fmt.Errorf("batch needs a topic")
+	}
+
+	if b.Delay <= 0 {
+		return fmt.Errorf("batch needs a delay")
+	}
+
+	return nil
+}
+
+// Adds a message to the batch, flush is called with the encoded envelope when the
+// batch is complete.
+func (b *batcher) add(topic string, payload []byte, flush func([]byte)) {
+
+	entry := batchEntry{Topic: topic}
+
+	var raw json.RawMessage
+
+	if err := json.Unmarshal(payload, &raw); err == nil {
+		entry.Payload = raw
+	} else {
+		entry.Data = payload
+	}
+
+	size := len(topic) + len(payload)
+	full := []*batchEnvelope{}
+
+	b.lock.Lock()
+
+	if b.Size > 0 && b.pending != nil && b.bytes+size > b.Size {
+		// this message would take the batch over the limit, send what there is first
+		full = append(full, b.take())
+	}
+
+	if b.pending == nil {
+		b.pending = &batchEnvelope{}
+		b.bytes = 0
+	}
+
+	b.pending.Batch = append(b.pending.Batch, entry)
+	b.bytes += size
+
+	if b.Size > 0 && b.bytes >= b.Size {
+		// full, or a message as big as the limit on its own
+		full = append(full, b.take())
+		b.lock.Unlock()
+		for _, envelope := range full {
+			b.encode(envelope, flush)
+		}
+		return
+	}
+
+	if b.timer == nil {
+		var timer *time.Timer
+		timer = time.AfterFunc(time.Duration(b.Delay)*time.Millisecond, func() {
+			b.lock.Lock()
+			if b.timer != timer {
+				// already flushed because it filled up
+				b.lock.Unlock()
+				return
+			}
+			envelope := b.take()
+			b.lock.Unlock()
+			b.encode(envelope, flush)
+		})
+		b.timer = timer
+	}
+
+	b.lock.Unlock()
+
+	for _, envelope := range full {
+		b.encode(envelope, flush)
+	}
+}
+
+// must hold the lock
+func (b *batcher) take() *batchEnvelope {
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	envelope := b.pending
+	b.pending = nil
+
+	return envelope
+}
+
+func (b *batcher) encode(envelope *batchEnvelope, flush func([]byte)) {
+
+	if envelope == nil {
+		return
+	}
+
+	if data, err := json.Marshal(envelope); err == nil {
+		flush(data)
+	}
+}
+
+// Drops the batch being collected.
+func (b *batcher) stop() {
+	b.lock.Lock()
+	b.take()
+	b.lock.Unlock()
+}
+
+// Unpacks an envelope into its messages.
+func unpackBatch(payload []byte) ([]*bridgeMessage, error) {
+
+	envelope := &batchEnvelope{}
+
+	if err := json.Unmarshal(payload, envelope); err != nil {
+		return nil, err
+	}
+
+	msgs := []*bridgeMessage{}
+
+	for _, entry := range envelope.Batch {
+
+		data := entry.Data
+
+		if len(entry.Payload) > 0 {
+			data = entry.Payload
+		}
+
+		msgs = append(msgs, &bridgeMessage{topic: entry.Topic, payload: data, size: len(entry.Topic) + len(data)})
+	}
+
+	return msgs, nil
+}
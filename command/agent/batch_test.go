@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadBatchSuite struct {
+	flushed chan []byte
+}
+
+var _ = Suite(&LoadBatchSuite{})
+
+func (s *LoadBatchSuite) SetUpTest(c *C) {
+	s.flushed = make(chan []byte, 5)
+}
+
+func (s *LoadBatchSuite) flush(envelope []byte) {
+	s.flushed <- envelope
+}
+
+func (s *LoadBatchSuite) next(c *C) []byte {
+	select {
+	case envelope := <-s.flushed:
+		return envelope
+	case <-time.After(time.Second):
+		c.Fatal("batch was never flushed")
+	}
+	return nil
+}
+
+func (s *LoadBatchSuite) TestDelay(c *C) {
+
+	batch := &batcher{Topic: "$cloud/batch", Delay: 20}
+	c.Assert(batch.compile(), IsNil)
+
+	batch.add("$cloud/device/a/channel/b", []byte(`{"params":[1]}`), s.flush)
+	batch.add("$cloud/device/a/channel/c", []byte(`raw`), s.flush)
+
+	c.Assert(string(s.next(c)), Equals, `{"$batch":[{"topic":"$cloud/device/a/channel/b","payload":{"params":[1]}},{"topic":"$cloud/device/a/channel/c","data":"cmF3"}]}`)
+	c.Assert(len(s.flushed), Equals, 0)
+}
+
+func (s *LoadBatchSuite) TestSize(c *C) {
+
+	batch := &batcher{Topic: "$cloud/batch", Delay: 60000, Size: 20}
+	c.Assert(batch.compile(), IsNil)
+
+	batch.add("a", []byte(`{"x":1}`), s.flush)
+	batch.add("b", []byte(`{"y":2}`), s.flush)
+	c.Assert(len(s.flushed), Equals, 0)
+
+	// c would take the batch over 20 bytes, so it is sent without c
+	batch.add("c", []byte(`{"z":3}`), s.flush)
+	msgs, err := unpackBatch(s.next(c))
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[1].topic, Equals, "b")
+
+	// c starts the next one, which d fills exactly
+	batch.add("d", []byte(`{"w":44444}`), s.flush)
+	msgs, err = unpackBatch(s.next(c))
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[0].topic, Equals, "c")
+
+	// a message bigger than the limit goes on its own
+	batch.add("e", []byte(`{"v":"too big to share"}`), s.flush)
+	msgs, err = unpackBatch(s.next(c))
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 1)
+
+	batch.add("f", []byte(`{}`), s.flush)
+	c.Assert(len(s.flushed), Equals, 0)
+	batch.stop()
+}
+
+func (s *LoadBatchSuite) TestUnpack(c *C) {
+
+	msgs, err := unpackBatch([]byte(`{"$batch":[{"topic":"$cloud/device/a/channel/b/reply","payload":{"result":true}},{"topic":"x","data":"cmF3"}]}`))
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[0].topic, Equals, "$cloud/device/a/channel/b/reply")
+	c.Assert(string(msgs[0].payload), Equals, `{"result":true}`)
+	c.Assert(string(msgs[1].payload), Equals, "raw")
+
+	_, err = unpackBatch([]byte(`not json`))
+	c.Assert(err, NotNil)
+}
+
+func (s *LoadBatchSuite) TestMatchRule(c *C) {
+
+	bridge := createBridge(&Config{})
+	bridge.cloudTopics = append([]replaceTopic{{on: "$cloud/#", unbatch: true}}, bridge.cloudTopics...)
+
+	rule, ok := bridge.matchRule("cloud", "$cloud/device/a/channel/b/reply")
+	c.Assert(ok, Equals, true)
+	c.Assert(rule.on, Equals, "$cloud/device/+/channel/+/reply")
+
+	_, ok = bridge.matchRule("cloud", "$cloud/unknown")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *LoadBatchSuite) TestEgressBytes(c *C) {
+
+	local := createFakeBroker()
+	cloud := createFakeBroker()
+
+	batch := &batcher{Topic: "$cloud/batch", Delay: 20}
+	c.Assert(batch.compile(), IsNil)
+
+	bridge := createBridge(&Config{LocalUrl: fakeLocalUrl, SerialNo: "1234"})
+	bridge.newClient = fakeClients(map[string]*fakeBroker{fakeLocalUrl: local, fakeCloudUrl: cloud})
+	bridge.localTopics = []replaceTopic{{on: "$device/#", replace: "$device", with: "$cloud/device", batch: batch}}
+
+	c.Assert(bridge.start(fakeCloudUrl, "fake-token"), IsNil)
+	defer bridge.stop()
+
+	local.publish("$device/a", []byte(`{"a":1}`))
+	local.publish("$device/b", []byte(`{"b":2}`))
+
+	c.Assert(waitFor(func() bool { return len(cloud.publishedOn("$cloud/batch")) == 1 }, time.Second), Equals, true)
+
+	// both messages are counted, their bytes only as part of the envelope
+	envelope := cloud.publishedOn("$cloud/batch")[0].payload
+	c.Assert(atomic.LoadInt64(&bridge.EgressCounter), Equals, int64(2))
+	c.Assert(atomic.LoadInt64(&bridge.EgressBytes), Equals, int64(len(envelope)))
+	c.Assert(atomic.LoadInt64(&bridge.BatchCounter), Equals, int64(1))
+}
+
+func (s *LoadBatchSuite) TestCompile(c *C) {
+	c.Assert((&batcher{Delay: 10}).compile(), NotNil)
+	c.Assert((&batcher{Topic: "$cloud/batch"}).compile(), NotNil)
+}
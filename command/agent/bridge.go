@@ -8,14 +8,20 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 	"github.com/juju/loggo"
 )
 
 var AlreadyConfigured = errors.New("Already configured")
 var AlreadyUnConfigured = errors.New("Already unconfigured")
+var ErrSameToken = errors.New("Token was already rejected")
+var ErrBridgeStopped = errors.New("Bridge was stopped")
+var ErrNoCloudUrl = errors.New("Not configured, a cloud url is required")
+
+// how long handling a lost connection may take before the bridge is considered hung
+const lossWatchdog = time.Minute
 
 //
 // Acts as a bridge between local and cloud brokers, this includes reconnecting
@@ -27,42 +33,180 @@ var AlreadyUnConfigured = errors.New("Already unconfigured")
 //
 type Bridge struct {
 	conf   *Config
-	local  *mqtt.MqttClient
-	remote *mqtt.MqttClient
+	local  mqttClient
+	remote mqttClient
 	log    loggo.Logger
 
+	// builds the clients for both legs
+	newClient clientFactory
+
+	// ids for the messages the bridge tags
+	newTraceId func() string
+
 	localTopics []replaceTopic
 	cloudTopics []replaceTopic
 
+	// optional duplicate suppression for each direction
+	localDedup *deduper
+	cloudDedup *deduper
+
+	// counts off the extra copies of messages matching several subscriptions, set
+	// under clientLock when each direction subscribes
+	localCopies *copies
+	cloudCopies *copies
+
+	keys *keyring
+
+	// optional round trip checks
+	prober *prober
+
+	// optional capture of every forwarded message
+	recorder *recorder
+
 	cloudUrl *url.URL
 	token    string
 
 	timer       *time.Timer
 	reconnectCh chan bool
 	shutdownCh  chan bool
+	eventCh     chan bridgeEvent
+
+	// how long to wait before trying to connect again
+	reconnectDelay time.Duration
+
+	// seconds between pings, and how long a broker has to accept a connection
+	keepAlive      uint
+	connectTimeout time.Duration
 
+	// written under clientLock, read them with flags() while the bridge is running
 	Configured bool
 	Connected  bool
 	Counter    int64
 
+	// set when the cloud rejects the token, cleared once a new token is supplied
+	CredentialsRequired bool
+
+	// when the bridge lost its connection, zero while connected or stopped
+	downSince time.Time
+
+	// set while a lost connection is being handled
+	lossSince time.Time
+
+	// panic if handling a lost connection hangs, off when systemd's watchdog is
+	// watching for that instead
+	panicOnHang bool
+
+	// the counters below are updated from several goroutines, use sync/atomic
 	IngressCounter int64
 	EgressCounter  int64
 
 	IngressBytes int64
 	EgressBytes  int64
 
+	// messages dropped by payload filters
+	FilteredCounter int64
+
+	// messages dropped by rate limits and sampling
+	RateLimitedCounter int64
+	SampledCounter     int64
+
+	// payload sizes before and after compression
+	CompressedRawBytes int64
+	CompressedBytes    int64
+
+	// envelopes published and unpacked
+	BatchCounter   int64
+	UnbatchCounter int64
+
+	// messages dropped because they couldn't be encrypted, or failed authentication
+	EncryptFailures int64
+	DecryptFailures int64
+
+	// messages suppressed as duplicates
+	DuplicateCounter int64
+
+	// messages forwarded by each rule, keyed by direction then filter
+	ruleCounters map[string]map[string]int64
+	countersLock sync.Mutex
+
 	LastError error
 
 	bridgeLock sync.Mutex
+	clientLock sync.RWMutex
+}
+
+// The bridge's state as of one moment, see flags().
+type bridgeFlags struct {
+	Configured          bool
+	Connected           bool
+	CredentialsRequired bool
+	LastError           error
+}
+
+// An event published on the bus on behalf of the bridge.
+type bridgeEvent struct {
+	topic string
+	data  interface{}
 }
 
 type replaceTopic struct {
 	on      string
 	replace string
 	with    string
+
+	// optional, replaces the prefix replace when set
+	rewrite *topicRewrite
+
+	// all must pass for a message to be forwarded
+	filters []*payloadFilter
+
+	// optional, shared by every copy of the rule
+	limiter *rateLimiter
+	sampler *sampler
+
+	// local rules compress payloads of at least compressMin bytes, cloud
+	// rules accept payloads compressed this way
+	compress    string
+	compressMin int
+
+	// local rules may collect messages into envelopes, cloud rules may unpack them
+	batch   *batcher
+	unbatch bool
+
+	// local rules encrypt payloads, cloud rules only accept encrypted payloads
+	encrypt bool
+
+	// cloud rules may subscribe as part of a $share group to split messages
+	// between several bridges
+	share string
+
+	// higher priority rules are matched first
+	priority int
+}
+
+// A message on its way through the bridge.
+type bridgeMessage struct {
+	topic   string
+	payload []byte
+	size    int // message size not payload size
+}
+
+// The topic filters a rule subscribes to, cloud rules which accept compressed
+// payloads also listen on the suffixed topics.
+func (r *replaceTopic) subscriptions(tag string) []string {
+	if tag == "cloud" && r.compress != "" && !strings.HasSuffix(r.on, "#") {
+		return []string{r.on, r.on + compressionSuffix(r.compress)}
+	}
+	return []string{r.on}
 }
 
+// Returns the topic to publish on, or an empty string when the rule's regex
+// doesn't match the topic.
 func (r *replaceTopic) updated(originalTopic string) string {
+	if r.rewrite != nil {
+		updated, _ := r.rewrite.apply(originalTopic)
+		return updated
+	}
 	return strings.Replace(originalTopic, r.replace, r.with, 1)
 }
 
@@ -120,23 +264,42 @@ var cloudTopics = []replaceTopic{
 }
 
 func createBridge(conf *Config) *Bridge {
-	return &Bridge{conf: conf, localTopics: localTopics, cloudTopics: cloudTopics, log: loggo.GetLogger("bridge")}
+	bridge := &Bridge{conf: conf, localTopics: localTopics, cloudTopics: cloudTopics, keys: conf.keys, reconnectDelay: 5 * time.Second, panicOnHang: true, keepAlive: 15, connectTimeout: 30 * time.Second, newClient: newPahoClient, newTraceId: createTraceId, log: loggo.GetLogger("bridge")}
+	if conf.rules != nil {
+		bridge.localTopics = conf.rules.local
+		bridge.cloudTopics = conf.rules.cloud
+		bridge.localDedup = conf.rules.localDedup
+		bridge.cloudDedup = conf.rules.cloudDedup
+	}
+	if bridge.keys == nil {
+		bridge.keys = createKeyring()
+	}
+	if conf.ProbeInterval > 0 {
+		bridge.prober = createProber(conf)
+	}
+	bridge.recorder = conf.recorder
+	return bridge
 }
 
 func (b *Bridge) start(cloudUrl string, token string) (err error) {
 
-	if b.Configured {
-		b.log.Warningf("Already configured.")
-		return AlreadyConfigured
-	}
-
 	defer b.bridgeLock.Unlock()
 
 	b.bridgeLock.Lock()
 
+	if b.flags().Configured {
+		b.log.Warningf("Already configured.")
+		return AlreadyConfigured
+	}
+
 	b.log.Infof("Connecting the bridge")
 
+	b.clientLock.Lock()
 	b.Configured = true
+	b.clientLock.Unlock()
+
+	logRedactor.addCloudUrl(cloudUrl)
+	logRedactor.addSecret(token)
 
 	url, err := url.Parse(cloudUrl)
 
@@ -144,8 +307,10 @@ func (b *Bridge) start(cloudUrl string, token string) (err error) {
 		return err
 	}
 
+	b.clientLock.Lock()
 	b.cloudUrl = url
 	b.token = token
+	b.clientLock.Unlock()
 
 	b.reconnectCh = make(chan bool, 1)
 	b.shutdownCh = make(chan bool, 1)
@@ -162,23 +327,29 @@ func (b *Bridge) start(cloudUrl string, token string) (err error) {
 
 func (b *Bridge) stop() error {
 
-	if !b.Configured {
+	defer b.bridgeLock.Unlock()
+
+	b.bridgeLock.Lock()
+
+	if !b.flags().Configured {
 		b.log.Warningf("Already unconfigured.")
 		return AlreadyUnConfigured
 	}
 
-	defer b.bridgeLock.Unlock()
+	b.log.Infof("Disconnecting bridge")
 
-	b.bridgeLock.Lock()
+	// a reconnect still under way sees this and throws its connections away
+	b.clientLock.Lock()
+	b.Configured = false
+	b.CredentialsRequired = false
+	b.clientLock.Unlock()
 
-	b.log.Infof("Disconnecting bridge")
+	// tell the worker to shutdown
+	b.shutdownCh <- true
 
-	if b.Configured {
-		// tell the worker to shutdown
-		b.shutdownCh <- true
+	b.markUp()
 
-		b.Configured = false
-	}
+	b.stopHeldMessages()
 
 	b.resetTimer()
 
@@ -187,15 +358,110 @@ func (b *Bridge) stop() error {
 	return nil
 }
 
-func (b *Bridge) connect() (err error) {
+// Swaps the cloud url and/or token of a running bridge, empty values keep the
+// current setting. The replacement cloud connection is established and subscribed
+// before the existing one is retired so traffic keeps flowing throughout.
+func (b *Bridge) reconfigure(cloudUrl string, token string) (err error) {
+
+	if !b.flags().Configured {
+		if cloudUrl == "" {
+			// there's no current url to keep
+			return ErrNoCloudUrl
+		}
+		return b.start(cloudUrl, token)
+	}
+
+	defer b.bridgeLock.Unlock()
+
+	b.bridgeLock.Lock()
+
+	return b.replaceCloud(cloudUrl, token)
+}
+
+// Does the work of reconfigure, bridgeLock must be held.
+func (b *Bridge) replaceCloud(cloudUrl string, token string) (err error) {
+
+	if !b.flags().Configured {
+		// stopped since reconfigure checked
+		return AlreadyUnConfigured
+	}
+
+	b.log.Infof("Reconfiguring the bridge")
 
-	if b.local, err = b.buildClient(b.conf.LocalUrl, ""); err != nil {
-		b.Connected = false
+	logRedactor.addCloudUrl(cloudUrl)
+	logRedactor.addSecret(token)
+
+	newUrl := b.cloudUrl
+
+	if cloudUrl != "" {
+		if newUrl, err = url.Parse(cloudUrl); err != nil {
+			return err
+		}
+	}
+
+	if token == "" {
+		token = b.token
+	}
+
+	if token != b.token || cloudUrl != "" {
+		// new credentials or a new destination, worth another try
+		b.clientLock.Lock()
+		b.CredentialsRequired = false
+		b.clientLock.Unlock()
+	}
+
+	flags := b.flags()
+
+	if flags.CredentialsRequired {
+		b.log.Warningf("Reconfigure without a new token, credentials are still required")
+	}
+
+	if !flags.Connected {
+		// nothing to hand over, the pending reconnect will pick up the new settings
+		b.clientLock.Lock()
+		b.cloudUrl = newUrl
+		b.token = token
+		b.clientLock.Unlock()
+
+		b.resetTimer()
+		if !flags.CredentialsRequired {
+			b.triggerReconnect()
+		}
+		return nil
+	}
+
+	remote, err := b.buildClient(newUrl.String(), token, "cloud")
+
+	if err != nil {
+		b.log.Errorf("Reconfigure failed, keeping existing connection %s", err)
 		return err
 	}
 
-	if b.remote, err = b.buildClient(b.cloudUrl.String(), b.token); err != nil {
-		b.Connected = false
+	if err = b.subscribe(remote, b.cloudTopics, "cloud"); err != nil {
+		b.log.Errorf("Reconfigure failed, keeping existing connection %s", err)
+		remote.disconnect()
+		return err
+	}
+
+	b.clientLock.Lock()
+	previous := b.remote
+	b.remote = remote
+	b.cloudUrl = newUrl
+	b.token = token
+	b.clientLock.Unlock()
+
+	// messages arriving on the retired client are dropped from here on
+	if previous != nil {
+		previous.disconnect()
+	}
+
+	return nil
+}
+
+func (b *Bridge) connect() (err error) {
+
+	if err = b.buildClients(); err != nil {
+		b.setConnected(false)
 		return err
 	}
 
@@ -204,20 +470,16 @@ func (b *Bridge) connect() (err error) {
 	}
 
 	// we are now connected
-	b.Connected = true
+	b.setConnected(true)
+	b.markUp()
 
 	return nil
 }
 
 func (b *Bridge) reconnect() (err error) {
 
-	if b.local, err = b.buildClient(b.conf.LocalUrl, ""); err != nil {
-		b.Connected = false
-		return err
-	}
-
-	if b.remote, err = b.buildClient(b.cloudUrl.String(), b.token); err != nil {
-		b.Connected = false
+	if err = b.buildClients(); err != nil {
+		b.setConnected(false)
 		return err
 	}
 
@@ -226,41 +488,115 @@ func (b *Bridge) reconnect() (err error) {
 	}
 
 	// we are now connected
+	b.clientLock.Lock()
 	b.Connected = true
 	b.LastError = nil
+	b.CredentialsRequired = false
+	b.clientLock.Unlock()
+
+	b.markUp()
 
 	return nil
 }
 
+// Connects both legs and puts them in place, unless the bridge was stopped while
+// they were connecting in which case they are closed again.
+func (b *Bridge) buildClients() error {
+
+	b.clientLock.RLock()
+	cloudUrl, token := b.cloudUrl.String(), b.token
+	b.clientLock.RUnlock()
+
+	var remote mqttClient
+
+	local, err := b.buildClient(b.conf.LocalUrl, "", "local")
+
+	if err == nil {
+		remote, err = b.buildClient(cloudUrl, token, "cloud")
+	}
+
+	b.clientLock.Lock()
+	stopped := !b.Configured
+	if !stopped {
+		b.local = local
+		b.remote = remote
+	}
+	b.clientLock.Unlock()
+
+	if stopped {
+		b.log.Infof("Bridge stopped while connecting, closing the new connections")
+		for _, client := range []mqttClient{local, remote} {
+			if client != nil {
+				client.disconnect()
+			}
+		}
+		return ErrBridgeStopped
+	}
+
+	return err
+}
+
 func (b *Bridge) subscriptions() (err error) {
 
-	if err = b.subscribe(b.local, b.remote, b.localTopics, "local"); err != nil {
+	b.clientLock.RLock()
+	local, remote := b.local, b.remote
+	b.clientLock.RUnlock()
+
+	if local == nil || remote == nil {
+		// disconnected by a stop since they were built
+		return ErrBridgeStopped
+	}
+
+	if err = b.subscribe(local, b.localTopics, "local"); err != nil {
 		return err
 	}
 
-	if err = b.subscribe(b.remote, b.local, b.cloudTopics, "cloud"); err != nil {
+	if err = b.subscribe(remote, b.cloudTopics, "cloud"); err != nil {
 		return err
 	}
+
+	if b.prober != nil {
+		// a fresh start for the new connections
+		b.prober.reset()
+	}
+
 	return nil
 
 }
 
 func (b *Bridge) disconnectAll() {
 	b.log.Infof("disconnectAll")
-	// we are now disconnected
+
+	// we are now disconnected, and the clients are retired before they are closed
+	b.clientLock.Lock()
+	local, remote := b.local, b.remote
+	b.local = nil
+	b.remote = nil
 	b.Connected = false
-	if b.local != nil && b.local.IsConnected() {
-		b.local.Disconnect(100)
+	b.clientLock.Unlock()
+
+	if local != nil {
+		local.disconnect()
 	}
-	if b.remote != nil && b.remote.IsConnected() {
-		b.remote.Disconnect(100)
+	if remote != nil {
+		remote.disconnect()
 	}
 }
 
 func (b *Bridge) mainBridgeLoop() {
 
+	var probeTick <-chan time.Time
+
+	if b.prober != nil {
+		ticker := time.NewTicker(b.prober.interval)
+		defer ticker.Stop()
+		probeTick = ticker.C
+	}
+
 	for {
 		select {
+		case <-probeTick:
+			b.probe()
 		case <-b.reconnectCh:
 			b.log.Infof("reconnecting")
 			if err := b.reconnect(); err != nil {
@@ -276,130 +612,596 @@ func (b *Bridge) mainBridgeLoop() {
 
 }
 
-func (b *Bridge) buildClient(server string, token string) (*mqtt.MqttClient, error) {
+func (b *Bridge) buildClient(server string, token string, tag string) (mqttClient, error) {
 
 	b.log.Infof("building client for %s", server)
 
-	opts := mqtt.NewClientOptions().AddBroker(server).SetTlsConfig(&tls.Config{InsecureSkipVerify: true})
+	client := b.newClient(&clientOptions{
+		server: server,
+		tls:    &tls.Config{InsecureSkipVerify: true},
 
-	if token != "" {
-		opts.SetUsername(token)
-	}
+		// the token is passed as the username
+		username: token,
 
-	opts.SetClientId(fmt.Sprintf("%d", time.Now().Unix()))
+		// nanosecond resolution so a replacement client never collides with the one it replaces
+		clientId: fmt.Sprintf("%d", time.Now().UnixNano()),
 
-	opts.SetKeepAlive(15) // set a 15 second ping time for ELB
+		keepAlive:      b.keepAlive, // 15 second pings by default for ELB
+		connectTimeout: b.connectTimeout,
 
-	// pretty much log the reason and quit
-	opts.SetOnConnectionLost(b.onConnectionLoss)
+		// subscriptions have no handlers, so every message comes through here once
+		onMessage: b.buildHandler(tag),
 
-	client := mqtt.NewClient(opts)
-	_, err := client.Start()
+		// pretty much log the reason and quit
+		onConnectionLost: b.onConnectionLoss,
+	})
 
-	return client, err
+	return client, client.connect()
 }
 
-func (b *Bridge) subscribe(src *mqtt.MqttClient, dst *mqtt.MqttClient, topics []replaceTopic, tag string) (err error) {
+func (b *Bridge) subscribe(src mqttClient, topics []replaceTopic, tag string) (err error) {
+
+	filters := subscriptionFilters(topics, tag)
+
+	b.clientLock.Lock()
+	if tag == "cloud" {
+		b.cloudCopies = createCopies(filters)
+	} else {
+		b.localCopies = createCopies(filters)
+	}
+	b.clientLock.Unlock()
+
+	for _, on := range filters {
 
-	for _, topic := range topics {
+		b.log.Infof("(%s) subscribed to %s", tag, on)
 
-		topicFilter, _ := mqtt.NewTopicFilter(topic.on, 0)
-		b.log.Infof("(%s) subscribed to %s", tag, topic.on)
+		// no handler, the client's default handler routes messages to rules
+		if err := src.subscribe(on, nil); err != nil {
+			return err
+		}
+	}
 
-		if receipt, err := src.StartSubscription(b.buildHandler(topic, tag, dst), topicFilter); err != nil {
+	if b.prober != nil {
+		if err := src.subscribe(b.prober.topic(tag), nil); err != nil {
 			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Bridge) unsubscribe(client mqttClient, topics []replaceTopic, tag string) {
+
+	topicNames := subscriptionFilters(topics, tag)
+
+	b.log.Infof("(%s) unsubscribed to %s", tag, topicNames)
+	client.unsubscribe(topicNames...)
+}
+
+// Every message a client receives is handled by the first rule, in order of
+// precedence, matching its topic. The broker sends a message once for each of our
+// subscriptions it matches, only the first of those copies is handled.
+func (b *Bridge) buildHandler(tag string) messageHandler {
+	return func(src mqttClient, msg *bridgeMessage) {
+		if _, current := b.destination(tag, src); !current {
+			// client was retired by a reconfigure, its replacement is forwarding
+			return
+		}
+		if b.prober != nil && msg.topic == b.prober.topic(tag) {
+			b.probeArrived(tag, msg)
+			return
+		}
+		if copies := b.copies(tag); copies != nil && copies.extra(msg, time.Now()) {
+			return
+		}
+		topic, ok := b.routeRule(tag, msg.topic)
+		if !ok {
+			logEvent(b.log, loggo.DEBUG, msgFields(tag, msg), "matches no rule")
+			return
+		}
+		if err := b.decode(topic, tag, msg); err != nil {
+			logEvent(b.log, loggo.WARNING, ruleFields(tag, topic, msg, err), "dropped")
+			return
+		}
+		if topic.unbatch {
+			b.unpack(tag, msg)
+			return
+		}
+		b.handle(topic, tag, msg)
+	}
+}
+
+// Runs a message through the rule's filters, duplicate suppression, rate limit and
+// sampling then forwards it.
+func (b *Bridge) handle(topic replaceTopic, tag string, msg *bridgeMessage) {
+	if !acceptPayload(topic.filters, msg.payload) {
+		atomic.AddInt64(&b.FilteredCounter, 1)
+		logEvent(b.log, loggo.DEBUG, ruleFields(tag, topic, msg, nil), "filtered")
+		return
+	}
+	if dedup := b.dedup(tag); dedup != nil && dedup.duplicate(msg, time.Now()) {
+		atomic.AddInt64(&b.DuplicateCounter, 1)
+		logEvent(b.log, loggo.DEBUG, ruleFields(tag, topic, msg, nil), "duplicate")
+		return
+	}
+	if topic.limiter != nil && !topic.limiter.allow(msg.topic, time.Now()) {
+		atomic.AddInt64(&b.RateLimitedCounter, 1)
+		logEvent(b.log, loggo.DEBUG, ruleFields(tag, topic, msg, nil), "rate limited")
+		return
+	}
+	if topic.sampler != nil {
+		forward, suppressed := topic.sampler.offer(msg.topic, msg, time.Now(), func(held *bridgeMessage) {
+			b.forward(topic, tag, held)
+		})
+		if suppressed {
+			atomic.AddInt64(&b.SampledCounter, 1)
+		}
+		if !forward {
+			return
+		}
+	}
+	b.forward(topic, tag, msg)
+}
+
+// Hands each message in an envelope to the first rule which matches its topic,
+// messages no rule matches are dropped.
+func (b *Bridge) unpack(tag string, envelope *bridgeMessage) {
+
+	msgs, err := unpackBatch(envelope.payload)
+
+	if err != nil {
+		logEvent(b.log, loggo.WARNING, msgFields(tag, envelope).withError(err), "bad batch")
+		return
+	}
+
+	atomic.AddInt64(&b.UnbatchCounter, 1)
+
+	for _, msg := range msgs {
+		if topic, ok := b.matchRule(tag, msg.topic); ok {
+			b.handle(topic, tag, msg)
 		} else {
-			<-receipt
-			b.log.Infof("(%s) subscribed to %+v", tag, topicFilter)
+			logEvent(b.log, loggo.WARNING, msgFields(tag, msg), "in batch matches no rule")
 		}
 	}
+}
+
+func (b *Bridge) dedup(tag string) *deduper {
+	if tag == "cloud" {
+		return b.cloudDedup
+	}
+	return b.localDedup
+}
+
+func (b *Bridge) copies(tag string) *copies {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+
+	if tag == "cloud" {
+		return b.cloudCopies
+	}
+	return b.localCopies
+}
+
+// Finds the first rule for the direction subscribed to the topic a message arrived on.
+func (b *Bridge) routeRule(tag string, topic string) (replaceTopic, bool) {
+
+	for _, rule := range b.rules(tag) {
+		for _, filter := range rule.subscriptions(tag) {
+			if matchTopic(filter, topic) {
+				return rule, true
+			}
+		}
+	}
+
+	return replaceTopic{}, false
+}
+
+func (b *Bridge) rules(tag string) []replaceTopic {
+	if tag == "cloud" {
+		return b.cloudTopics
+	}
+	return b.localTopics
+}
+
+// Finds the first rule for the direction matching the topic, envelope rules are skipped.
+func (b *Bridge) matchRule(tag string, topic string) (replaceTopic, bool) {
+
+	for _, rule := range b.rules(tag) {
+		if !rule.unbatch && matchTopic(rule.on, topic) {
+			return rule, true
+		}
+	}
+
+	return replaceTopic{}, false
+}
+
+// Undoes any encoding applied by the other side.
+func (b *Bridge) decode(topic replaceTopic, tag string, msg *bridgeMessage) error {
+
+	if tag != "cloud" {
+		return nil
+	}
+
+	if topic.encrypt {
+		payload, err := b.keys.decrypt(msg.topic, msg.payload)
+		if err != nil {
+			atomic.AddInt64(&b.DecryptFailures, 1)
+			return err
+		}
+		msg.payload = payload
+	}
+
+	if topic.compress == "" {
+		return nil
+	}
+
+	base, algorithm := splitCompressed(msg.topic)
+
+	if algorithm == "" {
+		return nil
+	}
+
+	payload, err := decompressPayload(algorithm, msg.payload)
+
+	if err != nil {
+		return err
+	}
+
+	msg.topic = base
+	msg.payload = payload
 
 	return nil
 }
 
-func (b *Bridge) unsubscribe(client *mqtt.MqttClient, topics []replaceTopic, tag string) {
+// Tags and publishes a message to the other side.
+func (b *Bridge) forward(topic replaceTopic, tag string, msg *bridgeMessage) {
+	dst, _ := b.destination(tag, nil)
+	if dst == nil {
+		return
+	}
+	updated := topic.updated(msg.topic)
+	if updated == "" {
+		logEvent(b.log, loggo.WARNING, ruleFields(tag, topic, msg, nil), "can't be rewritten")
+		return
+	}
+	size := int64(msg.size)
+	if tag == "local" && topic.batch != nil {
+		// counted once as part of its envelope
+		size = 0
+	}
+	b.updateCounters(tag, size)
+	b.countRule(tag, topic)
+	if b.recorder != nil {
+		b.recorder.record(tag, msg, updated, time.Now())
+	}
+	payload, trace := b.updateSource(msg.payload, b.buildSource(tag))
+	fields := ruleFields(tag, topic, msg, nil)
+	fields.Trace = trace
+	logEvent(b.log, loggo.DEBUG, fields, "updated: %s len: %d", updated, len(msg.payload))
+	if tag == "local" && topic.batch != nil {
+		topic.batch.add(updated, payload, func(envelope []byte) {
+			b.publishBatch(topic, envelope)
+		})
+		return
+	}
+	if tag == "local" {
+		var err error
+		if updated, payload, err = b.encode(topic, updated, payload); err != nil {
+			fields.Topic = updated
+			logEvent(b.log, loggo.WARNING, fields.withError(err), "dropped")
+			return
+		}
+	}
+	if err := dst.publish(updated, payload); err != nil {
+		fields.Topic = updated
+		logEvent(b.log, loggo.WARNING, fields.withError(err), "publish failed")
+	}
+}
 
-	topicNames := []string{}
+// Applies the rule's compression then encryption, returning the topic and payload
+// to publish to the cloud.
+func (b *Bridge) encode(topic replaceTopic, updated string, payload []byte) (string, []byte, error) {
 
-	for _, topic := range topics {
-		topicNames = append(topicNames, topic.on)
+	if topic.compress != "" {
+		updated, payload = b.compress(topic, updated, payload)
 	}
 
-	b.log.Infof("(%s) unsubscribed to %s", tag, topicNames)
-	client.EndSubscription(topicNames...)
+	if topic.encrypt {
+		encrypted, err := b.keys.encrypt(updated, payload)
+		if err != nil {
+			atomic.AddInt64(&b.EncryptFailures, 1)
+			return updated, nil, err
+		}
+		payload = encrypted
+	}
+
+	return updated, payload, nil
+}
+
+func (b *Bridge) publishBatch(topic replaceTopic, envelope []byte) {
+	dst, _ := b.destination("local", nil)
+	if dst == nil {
+		return
+	}
+	atomic.AddInt64(&b.BatchCounter, 1)
+	atomic.AddInt64(&b.EgressBytes, int64(len(envelope)))
+	updated, envelope, err := b.encode(topic, topic.batch.Topic, envelope)
+	if err != nil {
+		b.log.Warningf("(local) batch: %s dropped %s", updated, err)
+		return
+	}
+	b.log.Debugf("(local) batch: %s len: %d", updated, len(envelope))
+	if err := dst.publish(updated, envelope); err != nil {
+		b.log.Warningf("(local) batch: %s publish failed %s", updated, err)
+	}
+}
+
+// Compresses the payload if that makes it smaller, returning the topic and payload
+// to publish.
+func (b *Bridge) compress(topic replaceTopic, updated string, payload []byte) (string, []byte) {
+
+	if len(payload) < topic.compressMin {
+		return updated, payload
+	}
+
+	compressed, err := compressPayload(topic.compress, payload)
+
+	if err != nil {
+		logEvent(b.log, loggo.WARNING, logFields{Direction: "local", Rule: topic.on, Topic: updated, Bytes: len(payload), payload: payload, Error: err.Error()}, "compression failed")
+		return updated, payload
+	}
+
+	if len(compressed) >= len(payload) {
+		return updated, payload
+	}
+
+	atomic.AddInt64(&b.CompressedRawBytes, int64(len(payload)))
+	atomic.AddInt64(&b.CompressedBytes, int64(len(compressed)))
+
+	return updated + compressionSuffix(topic.compress), compressed
 }
 
-func (b *Bridge) buildHandler(topic replaceTopic, tag string, dst *mqtt.MqttClient) mqtt.MessageHandler {
-	return func(src *mqtt.MqttClient, msg mqtt.Message) {
-		if b.log.IsDebugEnabled() {
-			b.log.Debugf("(%s) topic: %s updated: %s len: %d", tag, msg.Topic(), topic.updated(msg.Topic()), len(msg.Payload()))
+// Drops any messages held back by sampling or batching.
+func (b *Bridge) stopHeldMessages() {
+	for _, topics := range [][]replaceTopic{b.localTopics, b.cloudTopics} {
+		for _, topic := range topics {
+			if topic.sampler != nil {
+				topic.sampler.stop()
+			}
+			if topic.batch != nil {
+				topic.batch.stop()
+			}
 		}
-		b.updateCounters(tag, msg)
-		payload := b.updateSource(msg.Payload(), b.buildSource(tag))
-		dst.PublishMessage(topic.updated(msg.Topic()), mqtt.NewMessage(payload))
+	}
+}
+
+// Returns the client messages received under the given tag are published to, and
+// whether src is still the active client for that tag.
+func (b *Bridge) destination(tag string, src mqttClient) (mqttClient, bool) {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+
+	switch tag {
+	case "local":
+		return b.remote, src == b.local
+	case "cloud":
+		return b.local, src == b.remote
+	}
+
+	return nil, false
+}
+
+func (b *Bridge) isCurrent(client mqttClient) bool {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+	return client != nil && (client == b.local || client == b.remote)
+}
+
+func (b *Bridge) triggerReconnect() {
+	select {
+	case b.reconnectCh <- true:
+	default:
+		// a reconnect is already pending
 	}
 }
 
 func (b *Bridge) scheduleReconnect(reason error) {
-	b.LastError = reason
+	b.clientLock.Lock()
+	stopped := !b.Configured
+	if !stopped {
+		b.LastError = reason
+	}
+	b.clientLock.Unlock()
+
+	if stopped {
+		// the connections were abandoned by a stop, there is nothing to go back to
+		return
+	}
+
+	b.markDown(time.Now())
 	b.disconnectAll()
 	b.resetTimer()
 
 	switch reason {
-	case mqtt.ErrBadCredentials:
-		b.log.Warningf("Reconnect failed trying again in 30s")
-
-		b.timer = time.AfterFunc(30*time.Second, func() {
-			b.reconnectCh <- true
-		})
+	case ErrBadCredentials, ErrNotAuthorized:
+		// retrying with the same token is pointless, wait for a new one
+		b.credentialsRejected(reason)
 
 	default:
-		b.log.Warningf("Reconnect failed trying again in 5s")
+		b.log.Warningf("Reconnect failed trying again in %s", b.reconnectDelay)
 		// TODO add exponential backoff
-		b.timer = time.AfterFunc(5*time.Second, func() {
-			b.reconnectCh <- true
-		})
+		b.setTimer(b.reconnectDelay, b.triggerReconnect)
 	}
 
 }
 
+func (b *Bridge) credentialsRejected(reason error) {
+	b.log.Warningf("Cloud rejected the token, waiting for new credentials")
+
+	b.clientLock.Lock()
+	b.CredentialsRequired = true
+	b.clientLock.Unlock()
+
+	b.clientLock.RLock()
+	host := b.cloudUrl.Host
+	b.clientLock.RUnlock()
+
+	b.emit(credentialsRequiredTopic, &credentialsEvent{
+		Url:       host,
+		LastError: logRedactor.redactError(reason),
+		Timestamp: time.Now().Unix(),
+	})
+
+	if b.conf.TokenCommand != "" {
+		b.setTimer(0, b.refreshToken)
+	}
+}
+
+// Asks the configured token command for a new token and resumes with it, if that
+// fails we try again in 30s. Nothing is done if the bridge was stopped or given a
+// token some other way while the command ran.
+func (b *Bridge) refreshToken() {
+
+	b.clientLock.RLock()
+	cloudUrl, rejected := b.cloudUrl.String(), b.token
+	b.clientLock.RUnlock()
+
+	b.log.Infof("Requesting a new token from %s", b.conf.TokenCommand)
+
+	token, err := runTokenCommand(b.conf.TokenCommand, cloudUrl, tokenCommandTimeout)
+
+	if err == nil && token == rejected {
+		err = ErrSameToken
+	}
+
+	// held so a stop or reconfigure can't slip in between the check and acting on it
+	defer b.bridgeLock.Unlock()
+
+	b.bridgeLock.Lock()
+
+	if flags := b.flags(); !flags.Configured || !flags.CredentialsRequired {
+		b.log.Infof("A new token is no longer needed")
+		return
+	}
+
+	if err != nil {
+		b.log.Warningf("Token command failed trying again in 30s %s", err)
+
+		b.setTimer(30*time.Second, b.refreshToken)
+		return
+	}
+
+	if err = b.replaceCloud("", token); err != nil {
+		b.log.Errorf("Unable to resume with the new token %s", err)
+	}
+}
+
+// Hands an event to the bus, dropped if nobody is listening or the bus is backed up.
+func (b *Bridge) emit(topic string, data interface{}) {
+	select {
+	case b.eventCh <- bridgeEvent{topic: topic, data: data}:
+	default:
+		b.log.Warningf("Dropped event for %s", topic)
+	}
+}
+
+// Replaces any pending retry with f after d, the timer is set from several goroutines.
+func (b *Bridge) setTimer(d time.Duration, f func()) {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.timer = time.AfterFunc(d, f)
+}
+
 func (b *Bridge) resetTimer() {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
 	if b.timer != nil {
 		b.timer.Stop()
 	}
 }
 
-func (b *Bridge) onConnectionLoss(client *mqtt.MqttClient, reason error) {
+func (b *Bridge) onConnectionLoss(client mqttClient, reason error) {
+	if !b.isCurrent(client) {
+		b.log.Infof("Retired connection closed %s", reason)
+		return
+	}
+
 	b.log.Errorf("Connection failed %s", reason)
 
 	// we are now disconnected
-	b.Connected = false
+	b.setConnected(false)
 
 	// setup a watchdog timer to catch failure to disconnect on ping loss
 	// see https://gist.github.com/jonseymour/5b21b015c640717ddf9d for example
 
+	b.setLossSince(time.Now())
+
 	completed := make(chan struct{})
-	timer := time.NewTimer(time.Minute * 1)
-	go func() {
-		select {
-		case <-timer.C:
-			panic("watchdog timed out after 1 minute")
-		case <-completed:
-		}
-	}()
+	if b.panicOnHang {
+		timer := time.NewTimer(lossWatchdog)
+		defer timer.Stop()
+		go func() {
+			select {
+			case <-timer.C:
+				panic("watchdog timed out after 1 minute")
+			case <-completed:
+			}
+		}()
+	}
 
 	b.scheduleReconnect(reason)
 
 	// cleanup the watchdog timer
 	close(completed)
-	timer.Stop()
+	b.setLossSince(time.Time{})
+}
+
+func (b *Bridge) setLossSince(since time.Time) {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+	b.lossSince = since
+}
+
+// Whether handling a lost connection has taken longer than the watchdog allows.
+func (b *Bridge) hung(now time.Time) bool {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+	return !b.lossSince.IsZero() && now.Sub(b.lossSince) > lossWatchdog
+}
+
+func (b *Bridge) setConnected(connected bool) {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+	b.Connected = connected
+}
+
+// A consistent copy of the state flags, safe to take while the bridge connects,
+// reconnects or stops on other goroutines.
+func (b *Bridge) flags() bridgeFlags {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+
+	return bridgeFlags{
+		Configured:          b.Configured,
+		Connected:           b.Connected,
+		CredentialsRequired: b.CredentialsRequired,
+		LastError:           b.LastError,
+	}
 }
 
 func (b *Bridge) IsConnected() bool {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+
 	if b.remote == nil || b.local == nil {
 		return false
 	}
-	return (b.remote.IsConnected() && b.local.IsConnected())
+	return (b.remote.isConnected() && b.local.isConnected())
 }
 
 func (b *Bridge) buildSource(tag string) string {
@@ -408,31 +1210,176 @@ func (b *Bridge) buildSource(tag string) string {
 	case "local":
 		return b.conf.SerialNo
 	case "cloud":
+		b.clientLock.RLock()
+		defer b.clientLock.RUnlock()
 		return "cloud-" + strings.Replace(b.cloudUrl.Host, ".", "_", -1) // encoded to look less wierd
 	}
 
 	return ""
 }
 
-func (b *Bridge) updateSource(payload []byte, source string) []byte {
+// Tags the payload with its source and a trace id, unless a bridge already has,
+// returning it along with the trace id it carries.
+func (b *Bridge) updateSource(payload []byte, source string) ([]byte, string) {
 
 	if !bytes.Contains(payload, []byte("$mesh-source")) {
-		payload = bytes.Replace(payload, []byte("{"), []byte(`{"$mesh-source":"`+source+`", `), 1)
+		payload = bytes.Replace(payload, []byte("{"), []byte(`{"$mesh-source":"`+source+`", "$mesh-trace":"`+b.newTraceId()+`", `), 1)
 	}
 
 	b.log.Debugf("msg %s", string(payload))
 
-	return payload
+	return payload, traceOf(payload)
+}
+
+// The log fields for a message arriving in a direction.
+func msgFields(tag string, msg *bridgeMessage) logFields {
+	return logFields{Direction: tag, Topic: msg.topic, Bytes: len(msg.payload), payload: msg.payload}
+}
+
+// The log fields for a message being handled by a rule, err may be nil.
+func ruleFields(tag string, topic replaceTopic, msg *bridgeMessage, err error) logFields {
+	fields := msgFields(tag, msg)
+	fields.Rule = topic.on
+	return fields.withError(err)
 }
 
-func (b *Bridge) updateCounters(tag string, msg mqtt.Message) {
+func (b *Bridge) updateCounters(tag string, size int64) {
 	switch tag {
 	case "local":
-		b.EgressCounter++
-		b.EgressBytes += int64(len(msg.Bytes())) // message size not payload size
+		atomic.AddInt64(&b.EgressCounter, 1)
+		atomic.AddInt64(&b.EgressBytes, size)
 	case "cloud":
-		b.IngressCounter++
-		b.IngressBytes += int64(len(msg.Bytes())) // message size not payload size
+		atomic.AddInt64(&b.IngressCounter, 1)
+		atomic.AddInt64(&b.IngressBytes, size)
 	}
 
 }
+
+func (b *Bridge) countRule(tag string, topic replaceTopic) {
+
+	b.countersLock.Lock()
+	defer b.countersLock.Unlock()
+
+	if b.ruleCounters == nil {
+		b.ruleCounters = map[string]map[string]int64{"local": {}, "cloud": {}}
+	}
+
+	b.ruleCounters[tag][topic.on]++
+}
+
+// How many messages each rule for the direction has forwarded, in order of precedence.
+func (b *Bridge) ruleStats(tag string) []ruleStat {
+
+	b.countersLock.Lock()
+	defer b.countersLock.Unlock()
+
+	stats := []ruleStat{}
+
+	for _, rule := range b.rules(tag) {
+		stats = append(stats, ruleStat{On: rule.on, Forwarded: b.ruleCounters[tag][rule.on]})
+	}
+
+	return stats
+}
+
+// Reports the connection state of the local and cloud legs separately.
+func (b *Bridge) legsConnected() (local bool, cloud bool) {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+
+	return b.local != nil && b.local.isConnected(), b.remote != nil && b.remote.isConnected()
+}
+
+// The cloud broker the bridge is pointed at, without any credentials.
+func (b *Bridge) endpoint() string {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+
+	if b.cloudUrl == nil {
+		return ""
+	}
+	return b.cloudUrl.Scheme + "://" + b.cloudUrl.Host
+}
+
+func (b *Bridge) markDown(now time.Time) {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	if b.downSince.IsZero() {
+		b.downSince = now
+	}
+}
+
+func (b *Bridge) markUp() {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	b.downSince = time.Time{}
+}
+
+// How long the bridge has been failing to connect, zero while it is connected.
+func (b *Bridge) downFor(now time.Time) time.Duration {
+	b.clientLock.RLock()
+	defer b.clientLock.RUnlock()
+
+	if b.downSince.IsZero() {
+		return 0
+	}
+	return now.Sub(b.downSince)
+}
+
+// Sends the next probe, unless too many have already been lost in which case the
+// connection is treated as lost.
+func (b *Bridge) probe() {
+
+	if !b.flags().Connected {
+		return
+	}
+
+	now := time.Now()
+
+	if b.prober.expire(now) {
+		b.log.Warningf("Lost %d probes in a row, reconnecting", b.prober.failLimit)
+
+		b.clientLock.RLock()
+		remote := b.remote
+		b.clientLock.RUnlock()
+
+		b.onConnectionLoss(remote, ErrProbeFailed)
+		return
+	}
+
+	b.clientLock.RLock()
+	local := b.local
+	b.clientLock.RUnlock()
+
+	if local == nil {
+		// disconnected since
+		return
+	}
+
+	if err := local.publish(b.prober.localTopic, b.prober.send(now)); err != nil {
+		b.log.Warningf("Unable to send probe %s", err)
+	}
+}
+
+// Passes a probe from the local broker on to the cloud, and completes the round
+// trip when it comes back.
+func (b *Bridge) probeArrived(tag string, msg *bridgeMessage) {
+
+	if tag == "cloud" {
+		b.prober.received(msg.payload, time.Now())
+		return
+	}
+
+	if dst, _ := b.destination(tag, nil); dst != nil {
+		dst.publish(b.prober.cloudTopic, msg.payload)
+	}
+}
+
+func (b *Bridge) probeStats() probeStats {
+	if b.prober == nil {
+		return probeStats{}
+	}
+	return b.prober.stats()
+}
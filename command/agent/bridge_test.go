@@ -1,6 +1,13 @@
 package agent
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
 	. "launchpad.net/gocheck"
 
 	"testing"
@@ -33,3 +40,252 @@ func (s *LoadBridgeSuite) TestConfig(c *C) {
 	c.Assert(res, Equals, exp)
 
 }
+
+func (s *LoadBridgeSuite) TestReconfigureDisconnected(c *C) {
+
+	s.agent.Configured = true
+	s.agent.reconnectCh = make(chan bool, 1)
+	s.agent.token = "old-token"
+
+	err := s.agent.reconfigure("ssl://new.ninjasphere.co:8883", "")
+	c.Assert(err, IsNil)
+
+	c.Assert(s.agent.cloudUrl.Host, Equals, "new.ninjasphere.co:8883")
+	c.Assert(s.agent.token, Equals, "old-token")
+	c.Assert(len(s.agent.reconnectCh), Equals, 1)
+
+	err = s.agent.reconfigure("", "new-token")
+	c.Assert(err, IsNil)
+
+	c.Assert(s.agent.cloudUrl.Host, Equals, "new.ninjasphere.co:8883")
+	c.Assert(s.agent.token, Equals, "new-token")
+	c.Assert(len(s.agent.reconnectCh), Equals, 1)
+}
+
+func (s *LoadBridgeSuite) TestCredentialsRejected(c *C) {
+
+	s.agent.Configured = true
+	s.agent.reconnectCh = make(chan bool, 1)
+	s.agent.eventCh = make(chan bridgeEvent, 1)
+	s.agent.cloudUrl, _ = url.Parse("ssl://dev.ninjasphere.co:8883")
+	s.agent.token = "expired"
+
+	s.agent.scheduleReconnect(ErrBadCredentials)
+
+	c.Assert(s.agent.flags().CredentialsRequired, Equals, true)
+	c.Assert(s.agent.timer, IsNil)
+
+	ev := <-s.agent.eventCh
+	c.Assert(ev.topic, Equals, credentialsRequiredTopic)
+	c.Assert(ev.data.(*credentialsEvent).Url, Equals, "dev.ninjasphere.co:8883")
+
+	// the same token won't get us anywhere
+	c.Assert(s.agent.reconfigure("", "expired"), IsNil)
+	c.Assert(s.agent.flags().CredentialsRequired, Equals, true)
+	c.Assert(len(s.agent.reconnectCh), Equals, 0)
+
+	c.Assert(s.agent.reconfigure("", "fresh"), IsNil)
+	c.Assert(s.agent.flags().CredentialsRequired, Equals, false)
+	c.Assert(len(s.agent.reconnectCh), Equals, 1)
+}
+
+func (s *LoadBridgeSuite) TestRoutePrecedence(c *C) {
+
+	s.agent.cloudTopics = []replaceTopic{
+		{on: "$cloud/device/+/channel/+/reply", replace: "$cloud/device", with: "$device", compress: compressGzip},
+		{on: "$cloud/device/#", replace: "$cloud/device", with: "$device"},
+	}
+
+	rule, ok := s.agent.routeRule("cloud", "$cloud/device/a/channel/b/reply/$gzip")
+	c.Assert(ok, Equals, true)
+	c.Assert(rule.compress, Equals, compressGzip)
+
+	// the remaining levels are kept by the catch all
+	rule, ok = s.agent.routeRule("cloud", "$cloud/device/a/b/c/d")
+	c.Assert(ok, Equals, true)
+	c.Assert(rule.on, Equals, "$cloud/device/#")
+	c.Assert(rule.updated("$cloud/device/a/b/c/d"), Equals, "$device/a/b/c/d")
+
+	_, ok = s.agent.routeRule("cloud", "$cloud/location/a")
+	c.Assert(ok, Equals, false)
+}
+
+// Runs the bridge against fake clients.
+type LoadFakeBridgeSuite struct {
+	local  *fakeBroker
+	cloud  *fakeBroker
+	bridge *Bridge
+}
+
+var _ = Suite(&LoadFakeBridgeSuite{})
+
+const (
+	fakeLocalUrl = "tcp://local:1883"
+	fakeCloudUrl = "ssl://cloud:8883"
+)
+
+// Numbers the trace ids so payloads can be compared.
+func fakeTraceIds() func() string {
+	next := 0
+	return func() string {
+		next++
+		return fmt.Sprintf("trace-%d", next)
+	}
+}
+
+func (s *LoadFakeBridgeSuite) SetUpTest(c *C) {
+	s.local = createFakeBroker()
+	s.cloud = createFakeBroker()
+
+	s.bridge = createBridge(&Config{LocalUrl: fakeLocalUrl, SerialNo: "1234"})
+	s.bridge.newClient = fakeClients(map[string]*fakeBroker{
+		fakeLocalUrl:       s.local,
+		fakeCloudUrl:       s.cloud,
+		"ssl://other:8883": s.cloud,
+	})
+	s.bridge.newTraceId = fakeTraceIds()
+	s.bridge.reconnectDelay = 10 * time.Millisecond
+	s.bridge.eventCh = make(chan bridgeEvent, 10)
+}
+
+func (s *LoadFakeBridgeSuite) TearDownTest(c *C) {
+	if s.bridge.flags().Configured {
+		s.bridge.stop()
+	}
+}
+
+func (s *LoadFakeBridgeSuite) TestForward(c *C) {
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "fake-token"), IsNil)
+	c.Assert(s.bridge.IsConnected(), Equals, true)
+	c.Assert(s.cloud.lastConnect().username, Equals, "fake-token")
+	c.Assert(s.local.subscribed("$device/+/channel/+"), Equals, true)
+
+	s.local.publish("$device/a/channel/b", []byte(`{"params":[1]}`))
+
+	msgs := s.cloud.publishedOn("$cloud/device/a/channel/b")
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(string(msgs[0].payload), Equals, `{"$mesh-source":"1234", "$mesh-trace":"trace-1", "params":[1]}`)
+
+	s.cloud.publish("$cloud/device/a/channel/b/reply", []byte(`{"result":true}`))
+
+	msgs = s.local.publishedOn("$device/a/channel/b/reply")
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(string(msgs[0].payload), Equals, `{"$mesh-source":"cloud-cloud:8883", "$mesh-trace":"trace-2", "result":true}`)
+
+	c.Assert(s.bridge.EgressCounter, Equals, int64(2))
+	c.Assert(s.bridge.IngressCounter, Equals, int64(1))
+}
+
+func (s *LoadFakeBridgeSuite) TestConnectionLost(c *C) {
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "fake-token"), IsNil)
+
+	// the cloud refuses us for a while after dropping the connection
+	s.cloud.refuse(ErrNotConnected)
+	s.cloud.drop(errors.New("EOF"))
+
+	c.Assert(s.bridge.IsConnected(), Equals, false)
+	c.Assert(s.bridge.flags().LastError, NotNil)
+
+	s.cloud.refuse(nil)
+	c.Assert(waitFor(s.bridge.IsConnected, time.Second), Equals, true)
+	c.Assert(s.cloud.subscribed("$cloud/device/+/channel/+/reply"), Equals, true)
+
+	s.local.publish("$device/a/channel/b", []byte(`{}`))
+	c.Assert(s.cloud.publishedOn("$cloud/device/a/channel/b"), HasLen, 1)
+}
+
+func (s *LoadFakeBridgeSuite) TestSubscribeFails(c *C) {
+
+	s.cloud.failSubscribes(errors.New("subscribe refused"))
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "fake-token"), ErrorMatches, "subscribe refused")
+	c.Assert(s.bridge.flags().Connected, Equals, false)
+
+	s.cloud.failSubscribes(nil)
+	c.Assert(waitFor(s.bridge.IsConnected, time.Second), Equals, true)
+}
+
+func (s *LoadFakeBridgeSuite) TestPublishFails(c *C) {
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "fake-token"), IsNil)
+
+	s.cloud.failPublishes(ErrNotConnected)
+	s.local.publish("$device/a/channel/b", []byte(`{}`))
+	c.Assert(s.cloud.publishedOn("$cloud/#"), HasLen, 0)
+
+	s.cloud.failPublishes(nil)
+	s.local.publish("$device/a/channel/b", []byte(`{}`))
+	c.Assert(s.cloud.publishedOn("$cloud/#"), HasLen, 1)
+}
+
+func (s *LoadFakeBridgeSuite) TestRejected(c *C) {
+
+	s.cloud.refuse(ErrBadCredentials)
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "fake-expired-token"), Equals, ErrBadCredentials)
+	c.Assert(s.bridge.flags().CredentialsRequired, Equals, true)
+	c.Assert((<-s.bridge.eventCh).topic, Equals, credentialsRequiredTopic)
+
+	s.cloud.refuse(nil)
+	c.Assert(s.bridge.reconfigure("", "fake-fresh-token"), IsNil)
+
+	c.Assert(waitFor(s.bridge.IsConnected, time.Second), Equals, true)
+	c.Assert(s.cloud.lastConnect().username, Equals, "fake-fresh-token")
+}
+
+func (s *LoadFakeBridgeSuite) TestTokenArrivesAfterStop(c *C) {
+
+	running := filepath.Join(c.MkDir(), "running")
+	s.bridge.conf.TokenCommand = "touch " + running + "; sleep 0.3; echo fake-late-token"
+	s.cloud.refuse(ErrBadCredentials)
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "fake-stale-token"), Equals, ErrBadCredentials)
+	c.Assert(waitFor(func() bool {
+		_, err := os.Stat(running)
+		return err == nil
+	}, time.Second), Equals, true)
+
+	c.Assert(s.bridge.stop(), IsNil)
+
+	// the token is thrown away rather than starting the bridge again
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(s.bridge.flags().Configured, Equals, false)
+	c.Assert(s.cloud.lastConnect().username, Equals, "fake-stale-token")
+
+	c.Assert(s.bridge.reconfigure("", "fake-other-token"), Equals, ErrNoCloudUrl)
+	c.Assert(s.bridge.flags().Configured, Equals, false)
+}
+
+func (s *LoadFakeBridgeSuite) TestReconfigureRetiresClient(c *C) {
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "fake-token"), IsNil)
+
+	retired := s.bridge.remote.(*fakeClient)
+
+	c.Assert(s.bridge.reconfigure("ssl://other:8883", ""), IsNil)
+	c.Assert(s.bridge.remote, Not(Equals), retired)
+	c.Assert(retired.isConnected(), Equals, false)
+
+	// anything still arriving on the old connection is ignored
+	retired.deliver(&brokerMessage{topic: "$cloud/device/a/channel/b/reply", payload: []byte(`{}`)})
+	c.Assert(s.local.publishedOn("$device/#"), HasLen, 0)
+
+	s.cloud.publish("$cloud/device/a/channel/b/reply", []byte(`{}`))
+	msgs := s.local.publishedOn("$device/a/channel/b/reply")
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(string(msgs[0].payload), Equals, `{"$mesh-source":"cloud-other:8883", "$mesh-trace":"trace-1", }`)
+}
+
+// Polls until done or the limit has passed.
+func waitFor(done func() bool, limit time.Duration) bool {
+	deadline := time.Now().Add(limit)
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,445 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+// MQTT control packet types, the high nibble of the fixed header
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// connack return codes
+const (
+	connAccepted       = 0
+	connBadCredentials = 4
+	connNotAuthorized  = 5
+)
+
+//
+// A small in-process MQTT broker so the bridge and bus can be tested against real
+// connections without outside services. It speaks enough of MQTT 3.1 and 3.1.1 for
+// our clients: connect with an optional credentials check, subscribe, unsubscribe,
+// publish at QoS 0, 1 and 2 (always delivered at QoS 0), ping and disconnect.
+// Every publish it receives is recorded so tests can wait for it.
+//
+type testBroker struct {
+	addr     string
+	listener net.Listener
+
+	// returns the connack code for a connect, nil accepts everyone
+	authenticate func(clientId string, username string) byte
+
+	sessions  map[*brokerSession]bool
+	published []brokerMessage
+	connects  []brokerConnect
+	lock      sync.Mutex
+}
+
+type brokerSession struct {
+	conn     net.Conn
+	clientId string
+	filters  map[string]bool
+	lock     sync.Mutex
+}
+
+type brokerMessage struct {
+	clientId string
+	topic    string
+	payload  []byte
+}
+
+type brokerConnect struct {
+	clientId string
+	username string
+	code     byte
+}
+
+var errBrokerTimeout = errors.New("timed out waiting on the test broker")
+
+// how long tests wait for something to happen on a broker
+const brokerWait = 5 * time.Second
+
+func startBroker(c *C) *testBroker {
+	broker := &testBroker{sessions: make(map[*brokerSession]bool)}
+	c.Assert(broker.listen("127.0.0.1:0"), IsNil)
+	return broker
+}
+
+func (b *testBroker) listen(addr string) error {
+
+	listener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	b.listener = listener
+	b.addr = listener.Addr().String()
+	b.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.addr
+}
+
+// Stops accepting connections and drops every client.
+func (b *testBroker) close() {
+	b.lock.Lock()
+	b.listener.Close()
+	b.lock.Unlock()
+	b.dropConnections()
+}
+
+// Brings a closed broker back on the same address.
+func (b *testBroker) restart(c *C) {
+	c.Assert(b.listen(b.addr), IsNil)
+}
+
+// Closes every client connection without a goodbye, like a network failure.
+func (b *testBroker) dropConnections() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for session := range b.sessions {
+		session.conn.Close()
+		delete(b.sessions, session)
+	}
+}
+
+// Delivers a message to subscribers as if a client had published it.
+func (b *testBroker) publish(topic string, payload []byte) {
+	b.route(&brokerMessage{clientId: "test", topic: topic, payload: payload})
+}
+
+func (b *testBroker) clients() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.sessions)
+}
+
+// Waits until some client has subscribed to exactly this filter.
+func (b *testBroker) waitSubscribed(filter string) error {
+	return b.wait(func() bool {
+		return b.subscribed(filter)
+	})
+}
+
+func (b *testBroker) subscribed(filter string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for session := range b.sessions {
+		session.lock.Lock()
+		subscribed := session.filters[filter]
+		session.lock.Unlock()
+		if subscribed {
+			return true
+		}
+	}
+	return false
+}
+
+// Waits for a message published on a topic matching the filter.
+func (b *testBroker) waitPublished(filter string) (msg brokerMessage, err error) {
+	err = b.wait(func() bool {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for _, published := range b.published {
+			if matchTopic(filter, published.topic) {
+				msg = published
+				return true
+			}
+		}
+		return false
+	})
+	return msg, err
+}
+
+func (b *testBroker) publishedOn(filter string) []brokerMessage {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	msgs := []brokerMessage{}
+	for _, published := range b.published {
+		if matchTopic(filter, published.topic) {
+			msgs = append(msgs, published)
+		}
+	}
+	return msgs
+}
+
+func (b *testBroker) lastConnect() brokerConnect {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.connects) == 0 {
+		return brokerConnect{}
+	}
+	return b.connects[len(b.connects)-1]
+}
+
+func (b *testBroker) wait(done func() bool) error {
+	deadline := time.Now().Add(brokerWait)
+	for time.Now().Before(deadline) {
+		if done() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errBrokerTimeout
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	session := &brokerSession{conn: conn, filters: make(map[string]bool)}
+
+	defer func() {
+		b.lock.Lock()
+		delete(b.sessions, session)
+		b.lock.Unlock()
+	}()
+
+	for {
+		header, body, err := readPacket(reader)
+
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+
+		case packetConnect:
+			code := b.connect(session, body)
+			session.write(packetConnack<<4, []byte{0, code})
+			if code != connAccepted {
+				return
+			}
+
+		case packetPublish:
+			qos := (header >> 1) & 3
+			topic, rest := readString(body)
+			if qos > 0 {
+				id := rest[:2]
+				rest = rest[2:]
+				if qos == 1 {
+					session.write(packetPuback<<4, id)
+				} else {
+					session.write(packetPubrec<<4, id)
+				}
+			}
+			b.route(&brokerMessage{clientId: session.clientId, topic: topic, payload: rest})
+
+		case packetPubrel:
+			session.write(packetPubcomp<<4, body[:2])
+
+		case packetSubscribe:
+			id, rest := body[:2], body[2:]
+			granted := []byte{}
+			for len(rest) > 0 {
+				var filter string
+				filter, rest = readString(rest)
+				rest = rest[1:] // requested qos
+				session.lock.Lock()
+				session.filters[filter] = true
+				session.lock.Unlock()
+				granted = append(granted, 0)
+			}
+			session.write(packetSuback<<4, append(id, granted...))
+
+		case packetUnsubscribe:
+			id, rest := body[:2], body[2:]
+			for len(rest) > 0 {
+				var filter string
+				filter, rest = readString(rest)
+				session.lock.Lock()
+				delete(session.filters, filter)
+				session.lock.Unlock()
+			}
+			session.write(packetUnsuback<<4, id)
+
+		case packetPingreq:
+			session.write(packetPingresp<<4, nil)
+
+		case packetDisconnect:
+			return
+		}
+	}
+}
+
+func (b *testBroker) connect(session *brokerSession, body []byte) byte {
+
+	_, rest := readString(body) // protocol name, MQIsdp or MQTT
+	flags := rest[1]
+	rest = rest[4:] // level, flags and keep alive
+
+	clientId, rest := readString(rest)
+
+	if flags&0x04 != 0 {
+		_, rest = readString(rest) // will topic
+		_, rest = readString(rest) // will message
+	}
+
+	username := ""
+	if flags&0x80 != 0 {
+		username, rest = readString(rest)
+	}
+
+	code := byte(connAccepted)
+	if b.authenticate != nil {
+		code = b.authenticate(clientId, username)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.connects = append(b.connects, brokerConnect{clientId: clientId, username: username, code: code})
+
+	if code == connAccepted {
+		session.clientId = clientId
+		b.sessions[session] = true
+	}
+
+	return code
+}
+
+// Records a message and hands it to every session with a matching subscription,
+// once for each of its filters that match as brokers like mosquitto do.
+func (b *testBroker) route(msg *brokerMessage) {
+
+	b.lock.Lock()
+	b.published = append(b.published, *msg)
+	sessions := []*brokerSession{}
+	for session := range b.sessions {
+		sessions = append(sessions, session)
+	}
+	b.lock.Unlock()
+
+	for _, session := range sessions {
+		for i := session.matches(msg.topic); i > 0; i-- {
+			body := appendString(nil, msg.topic)
+			session.write(packetPublish<<4, append(body, msg.payload...))
+		}
+	}
+}
+
+// How many of the session's filters match the topic.
+func (s *brokerSession) matches(topic string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	matches := 0
+	for filter := range s.filters {
+		if strings.HasPrefix(filter, sharePrefix) {
+			// $share/<group>/<filter>
+			filter = strings.SplitN(filter, "/", 3)[2]
+		}
+		if matchTopic(filter, topic) {
+			matches++
+		}
+	}
+	return matches
+}
+
+func (s *brokerSession) write(header byte, body []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	writePacket(s.conn, header, body)
+}
+
+func writePacket(conn net.Conn, header byte, body []byte) error {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := conn.Write(append(packet, body...))
+	return err
+}
+
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+
+	header, err := reader.ReadByte()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+
+	for {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+
+	_, err = io.ReadFull(reader, body)
+
+	return header, body, err
+}
+
+func readString(data []byte) (string, []byte) {
+	length := int(binary.BigEndian.Uint16(data))
+	return string(data[2 : 2+length]), data[2+length:]
+}
+
+func appendString(data []byte, str string) []byte {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(str)))
+	return append(append(data, length...), str...)
+}
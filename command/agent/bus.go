@@ -4,39 +4,96 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/juju/loggo"
-
-	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 )
 
 const (
-	connectTopic    = "$sphere/bridge/connect"
-	disconnectTopic = "$sphere/bridge/disconnect"
-	statusTopic     = "$sphere/bridge/status"
-	responseTopic   = "$sphere/bridge/response"
+	connectTopic     = "$sphere/bridge/connect"
+	disconnectTopic  = "$sphere/bridge/disconnect"
+	reconfigureTopic = "$sphere/bridge/reconfigure"
+	statusTopic      = "$sphere/bridge/status"
+	responseTopic    = "$sphere/bridge/response"
+	keysTopic        = "$sphere/bridge/keys"
+	logTopic         = "$sphere/bridge/log"
+
+	statusQueryTopic = "$sphere/bridge/status/query"
+	statusReplyTopic = "$sphere/bridge/status/reply"
+
+	credentialsRequiredTopic = "$sphere/bridge/credentials/required"
 )
 
+// how long the background job may go without turning over before the bus is
+// considered stuck
+const busStaleAfter = 30 * time.Second
+
 /*
  Just manages all the data going into out of this service.
 */
 type Bus struct {
 	conf         *Config
 	agent        *Agent
-	client       *mqtt.MqttClient
+	client       mqttClient
+	newClient    clientFactory
 	statusTicker *time.Ticker
+	shutdownCh   chan bool
+	done         chan struct{}
 	log          loggo.Logger
+
+	// told once the bus is subscribed, optional
+	notifier *notifier
+
+	// when the background job last went round its loop
+	lastActivity time.Time
+	activityLock sync.Mutex
 }
 
 type connectRequest struct {
 	Id    string `json:"id"`
 	Url   string `json:"url"`
 	Token string `json:"token"`
+	requestAuth
+}
+
+// either field may be left empty to keep the current value
+type reconfigureRequest struct {
+	Id    string `json:"id"`
+	Url   string `json:"url"`
+	Token string `json:"token"`
+	requestAuth
 }
 
 type disconnectRequest struct {
 	Id string `json:"id"`
+	requestAuth
+}
+
+// adds the base64 encoded key under keyId, or just makes keyId current when no key
+// is given, then drops the key named in remove
+type keysRequest struct {
+	Id      string `json:"id"`
+	KeyId   string `json:"keyId"`
+	Key     string `json:"key"`
+	Current bool   `json:"current"`
+	Remove  string `json:"remove"`
+	requestAuth
+}
+
+// sets the levels of the named modules, eg. {"bridge":"DEBUG"}, and turns paho
+// tracing on or off, going back to the startup levels after revert seconds if set
+type logRequest struct {
+	Id     string            `json:"id"`
+	Levels map[string]string `json:"levels"`
+	Trace  *bool             `json:"trace"`
+	Revert int               `json:"revert"`
+	requestAuth
+}
+
+// asks the agent for a statusReport, which is published with the same id
+type statusQuery struct {
+	Id string `json:"id"`
 }
 
 type statusEvent struct {
@@ -50,6 +107,24 @@ type resultStatus struct {
 	LastError  string `json:"lastError"`
 }
 
+// everything in a statsEvent plus the detail the status command shows
+type statusReport struct {
+	Id string `json:"id"`
+	statsEvent
+
+	LocalConnected bool   `json:"localConnected"`
+	CloudConnected bool   `json:"cloudConnected"`
+	Endpoint       string `json:"endpoint"`
+
+	LocalRules []ruleStat `json:"localRules"`
+	CloudRules []ruleStat `json:"cloudRules"`
+}
+
+type ruleStat struct {
+	On        string `json:"on"`
+	Forwarded int64  `json:"forwarded"`
+}
+
 type statsEvent struct {
 
 	// memory related information
@@ -63,6 +138,31 @@ type statsEvent struct {
 	Configured bool  `json:"configured"`
 	Timestamp  int64 `json:"timestamp"`
 
+	CredentialsRequired bool  `json:"credentialsRequired"`
+	RejectedCounter     int64 `json:"rejectedCounter"`
+	FilteredCounter     int64 `json:"filteredCounter"`
+	RateLimitedCounter  int64 `json:"rateLimitedCounter"`
+	SampledCounter      int64 `json:"sampledCounter"`
+
+	CompressedRawBytes int64   `json:"compressedRawBytes"`
+	CompressedBytes    int64   `json:"compressedBytes"`
+	CompressionRatio   float64 `json:"compressionRatio"`
+
+	BatchCounter   int64 `json:"batchCounter"`
+	UnbatchCounter int64 `json:"unbatchCounter"`
+
+	EncryptFailures int64 `json:"encryptFailures"`
+	DecryptFailures int64 `json:"decryptFailures"`
+
+	DuplicateCounter int64 `json:"duplicateCounter"`
+
+	// round trips across the bridge, latencies are in ms
+	ProbeSent       int64   `json:"probeSent"`
+	ProbeLost       int64   `json:"probeLost"`
+	ProbeLatencyP50 float64 `json:"probeLatencyP50"`
+	ProbeLatencyP90 float64 `json:"probeLatencyP90"`
+	ProbeLatencyP99 float64 `json:"probeLatencyP99"`
+
 	IngressCounter int64 `json:"ingressCounter"`
 	EgressCounter  int64 `json:"egressCounter"`
 
@@ -72,57 +172,68 @@ type statsEvent struct {
 
 func createBus(conf *Config, agent *Agent) *Bus {
 
-	return &Bus{conf: conf, agent: agent, log: loggo.GetLogger("bus")}
+	return &Bus{conf: conf, agent: agent, newClient: newPahoClient, shutdownCh: make(chan bool, 1), done: make(chan struct{}), log: loggo.GetLogger("bus")}
 }
 
 func (b *Bus) listen() {
-	b.log.Infof("connecting to the bus")
+	defer close(b.done)
 
-	opts := mqtt.NewClientOptions().AddBroker(b.conf.LocalUrl).SetClientId("mqtt-bridgeify-bus")
+	b.log.Infof("connecting to the bus")
 
-	b.client = mqtt.NewClient(opts)
+	b.client = b.newClient(&clientOptions{server: b.conf.LocalUrl, clientId: "mqtt-bridgeify-bus"})
 
-	_, err := b.client.Start()
+	err := b.client.connect()
 	if err != nil {
 		b.log.Errorf("Can't start connection: %s", err)
 	} else {
 		b.log.Infof("Connected as %s\n", b.conf.LocalUrl)
 	}
 
-	topicFilter, _ := mqtt.NewTopicFilter(connectTopic, 0)
-	if receipt, err := b.client.StartSubscription(b.handleConnect, topicFilter); err != nil {
-		b.log.Errorf("Subscription Failed: %s", err)
-		panic(err)
-	} else {
-		<-receipt
-		b.log.Infof("Subscribed to: %+v", topicFilter)
+	handlers := []struct {
+		topic   string
+		handler messageHandler
+	}{
+		{connectTopic, b.handleConnect},
+		{disconnectTopic, b.handleDisconnect},
+		{reconfigureTopic, b.handleReconfigure},
+		{statusQueryTopic, b.handleStatusQuery},
+		{keysTopic, b.handleKeys},
+		{logTopic, b.handleLog},
 	}
 
-	topicFilter, _ = mqtt.NewTopicFilter(disconnectTopic, 0)
-	if receipt, err := b.client.StartSubscription(b.handleDisconnect, topicFilter); err != nil {
-		b.log.Errorf("Subscription Failed: %s", err)
-		panic(err)
-	} else {
-		<-receipt
-		b.log.Infof("Subscribed to: %+v", topicFilter)
+	for _, h := range handlers {
+		if err := b.client.subscribe(h.topic, h.handler); err != nil {
+			b.log.Errorf("Subscription Failed: %s", err)
+			panic(err)
+		}
+		b.log.Infof("Subscribed to: %s", h.topic)
+	}
+
+	if b.notifier != nil {
+		b.notifier.ready()
 	}
 
 	ev := &statusEvent{Status: "started"}
 
-	b.client.PublishMessage(statusTopic, b.encodeRequest(ev))
+	b.client.publish(statusTopic, b.encodeRequest(ev))
 
 	b.setupBackgroundJob()
 
 }
 
-func (b *Bus) handleConnect(client *mqtt.MqttClient, msg mqtt.Message) {
+func (b *Bus) handleConnect(client mqttClient, msg *bridgeMessage) {
 	b.log.Infof("handleConnect")
 	req := &connectRequest{}
-	err := b.decodeRequest(&msg, req)
+	err := b.decodeRequest(msg.payload, req)
 	if err != nil {
 		b.log.Errorf("Unable to decode connect request %s", err)
 	}
 
+	if err := b.agent.authorize(connectTopic, req); err != nil {
+		b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+		return
+	}
+
 	if err := b.agent.startBridge(req); err != nil {
 		// send out a bad result
 		b.sendResult(req.Id, false, true, err)
@@ -133,28 +244,110 @@ func (b *Bus) handleConnect(client *mqtt.MqttClient, msg mqtt.Message) {
 
 }
 
-func (b *Bus) handleDisconnect(client *mqtt.MqttClient, msg mqtt.Message) {
+func (b *Bus) handleReconfigure(client mqttClient, msg *bridgeMessage) {
+	b.log.Infof("handleReconfigure")
+	req := &reconfigureRequest{}
+	err := b.decodeRequest(msg.payload, req)
+	if err != nil {
+		b.log.Errorf("Unable to decode reconfigure request %s", err)
+		b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+		return
+	}
+
+	if err = b.agent.authorize(reconfigureTopic, req); err != nil {
+		b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+		return
+	}
+
+	err = b.agent.reconfigureBridge(req)
+	// send out a result
+	b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+}
+
+func (b *Bus) handleStatusQuery(client mqttClient, msg *bridgeMessage) {
+	req := &statusQuery{}
+	if err := b.decodeRequest(msg.payload, req); err != nil {
+		b.log.Errorf("Unable to decode status query %s", err)
+		return
+	}
+
+	b.client.publish(statusReplyTopic, b.encodeRequest(b.agent.getReport(req.Id)))
+}
+
+func (b *Bus) handleKeys(client mqttClient, msg *bridgeMessage) {
+	b.log.Infof("handleKeys")
+	req := &keysRequest{}
+	err := b.decodeRequest(msg.payload, req)
+	if err != nil {
+		b.log.Errorf("Unable to decode keys request %s", err)
+		b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+		return
+	}
+
+	if err = b.agent.authorize(keysTopic, req); err != nil {
+		b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+		return
+	}
+
+	err = b.agent.updateKeys(req)
+	// send out a result
+	b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+}
+
+func (b *Bus) handleLog(client mqttClient, msg *bridgeMessage) {
+	b.log.Infof("handleLog")
+	req := &logRequest{}
+	err := b.decodeRequest(msg.payload, req)
+	if err != nil {
+		b.log.Errorf("Unable to decode log request %s", err)
+		b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+		return
+	}
+
+	if err = b.agent.authorize(logTopic, req); err != nil {
+		b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+		return
+	}
+
+	err = b.agent.setLogLevels(req)
+	// send out a result
+	b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+}
+
+func (b *Bus) handleDisconnect(client mqttClient, msg *bridgeMessage) {
 	b.log.Infof("handleDisconnect")
 	req := &disconnectRequest{}
-	err := b.decodeRequest(&msg, req)
+	err := b.decodeRequest(msg.payload, req)
 	if err != nil {
 		b.log.Errorf("Unable to decode disconnect request %s", err)
 	}
+
+	if err = b.agent.authorize(disconnectTopic, req); err != nil {
+		b.sendResult(req.Id, b.agent.bridge.IsConnected(), b.agent.bridge.flags().Configured, err)
+		return
+	}
+
 	err = b.agent.stopBridge(req)
 	// send out a result
 	b.sendResult(req.Id, true, true, err)
 }
 
-func (b *Bus) sendResult(id string, connected bool, configured bool, result error) {
+// Ends the background job and leaves the local broker.
+// Waits for listen to return, so the client it made is the one disconnected.
+func (b *Bus) stop() {
+	b.shutdownCh <- true
+	<-b.done
+	if b.client != nil {
+		b.client.disconnect()
+	}
+}
 
-	var lastError string
+func (b *Bus) sendResult(id string, connected bool, configured bool, result error) {
 
-	if result != nil {
-		lastError = result.Error()
-	}
+	lastError := logRedactor.redactError(result)
 
 	ev := &resultStatus{Id: id, Connected: connected, Configured: configured, LastError: lastError}
-	b.client.PublishMessage(responseTopic, b.encodeRequest(ev))
+	b.client.publish(responseTopic, b.encodeRequest(ev))
 }
 
 func (b *Bus) setupBackgroundJob() {
@@ -163,28 +356,61 @@ func (b *Bus) setupBackgroundJob() {
 	metricsTicker := time.NewTicker(5 * time.Second)
 
 	for {
+		b.touch()
+
 		select {
 		case <-b.statusTicker.C:
 			// emit the status
 			status := b.agent.getStatus()
 			b.log.Debugf("status %+v", status)
-			b.client.PublishMessage(statusTopic, b.encodeRequest(status))
+			b.client.publish(statusTopic, b.encodeRequest(status))
 		case <-metricsTicker.C:
 			metrics := b.agent.getMetrics()
 			b.log.Debugf("metrics %+v", metrics)
-			b.client.PublishMessage(fmt.Sprintf("$node/%s/module/status", b.conf.SerialNo), b.encodeRequest(metrics))
+			b.client.publish(fmt.Sprintf("$node/%s/module/status", b.conf.SerialNo), b.encodeRequest(metrics))
+		case ev := <-b.agent.eventCh:
+			b.log.Infof("event %s", ev.topic)
+			b.client.publish(ev.topic, b.encodeRequest(ev.data))
+		case <-b.shutdownCh:
+			b.statusTicker.Stop()
+			metricsTicker.Stop()
+			return
 
 		}
 	}
 
 }
 
-func (b *Bus) encodeRequest(data interface{}) *mqtt.Message {
+func (b *Bus) touch() {
+	b.activityLock.Lock()
+	defer b.activityLock.Unlock()
+	b.lastActivity = time.Now()
+}
+
+// Whether the bus is connected and its background job still turning over, which it
+// does at least every 5 seconds when healthy.
+func (b *Bus) alive(now time.Time) (bool, string) {
+
+	if b.client == nil || !b.client.isConnected() {
+		return false, "bus is not connected"
+	}
+
+	b.activityLock.Lock()
+	defer b.activityLock.Unlock()
+
+	if idle := now.Sub(b.lastActivity); idle > busStaleAfter {
+		return false, fmt.Sprintf("bus has been stuck for %s", idle-idle%time.Second)
+	}
+
+	return true, ""
+}
+
+func (b *Bus) encodeRequest(data interface{}) []byte {
 	buf := bytes.NewBuffer(nil)
 	json.NewEncoder(buf).Encode(data)
-	return mqtt.NewMessage(buf.Bytes())
+	return buf.Bytes()
 }
 
-func (b *Bus) decodeRequest(msg *mqtt.Message, data interface{}) error {
-	return json.NewDecoder(bytes.NewBuffer(msg.Payload())).Decode(data)
+func (b *Bus) decodeRequest(payload []byte, data interface{}) error {
+	return json.NewDecoder(bytes.NewBuffer(payload)).Decode(data)
 }
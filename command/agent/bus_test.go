@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"strings"
 
-	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 	. "launchpad.net/gocheck"
 )
 
@@ -40,8 +39,7 @@ func (s *LoadBusSuite) TestEncode(c *C) {
 
 func (s *LoadBusSuite) TestDecode(c *C) {
 	req := &connectRequest{}
-	msg := mqtt.NewMessage([]byte(s.sampleJson))
-	err := s.bus.decodeRequest(msg, req)
+	err := s.bus.decodeRequest([]byte(s.sampleJson), req)
 	c.Assert(err, IsNil)
 	c.Assert(req, DeepEquals, s.connectReq)
 }
@@ -49,3 +47,37 @@ func (s *LoadBusSuite) TestDecode(c *C) {
 func trim(str string) string {
 	return strings.Trim(str, "\n\r")
 }
+
+func (s *LoadBusSuite) TestDecodeReconfigure(c *C) {
+	req := &reconfigureRequest{}
+	err := s.bus.decodeRequest([]byte(`{"id":"123","token":"456456456"}`), req)
+	c.Assert(err, IsNil)
+	c.Assert(req, DeepEquals, &reconfigureRequest{Id: "123", Token: "456456456"})
+}
+
+func (s *LoadBusSuite) TestStatusReport(c *C) {
+
+	agent := createAgent(&Config{})
+	agent.bridge.localTopics = []replaceTopic{{on: "$device/#", replace: "$device", with: "$cloud/device"}}
+	agent.bridge.countRule("local", agent.bridge.localTopics[0])
+	agent.bridge.countRule("local", agent.bridge.localTopics[0])
+
+	report := agent.getReport("abc")
+
+	data, err := json.Marshal(report)
+	c.Assert(err, IsNil)
+
+	decoded := &statusReport{}
+	c.Assert(json.Unmarshal(data, decoded), IsNil)
+	c.Assert(decoded.Id, Equals, "abc")
+	c.Assert(decoded.Configured, Equals, false)
+	c.Assert(decoded.LocalRules, DeepEquals, []ruleStat{{On: "$device/#", Forwarded: 2}})
+	c.Assert(decoded.CloudRules, HasLen, len(cloudTopics))
+
+	// the embedded counters sit at the top level, the same as on the status topic
+	c.Assert(strings.Contains(string(data), `"egressCounter":0`), Equals, true)
+
+	out := formatReport(decoded)
+	c.Assert(strings.Contains(out, "bridge:      disconnected, not configured"), Equals, true)
+	c.Assert(strings.Contains(out, "       2 $device/#"), Equals, true)
+}
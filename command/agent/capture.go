@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// A bridged message as written to the capture file, one JSON object per line. The
+// payload is the one the bridge received, before it was tagged or encoded, and is
+// base64 encoded so binary payloads survive.
+type captureRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Topic     string    `json:"topic"`
+	Updated   string    `json:"updated"`
+	Payload   []byte    `json:"payload"`
+}
+
+//
+// Appends every message the bridge forwards to a capture file, so the exact
+// sequence behind a problem can be looked at or replayed later. Once the file
+// reaches its size limit it is renamed to file.1, file.1 to file.2 and so on,
+// keeping at most files old captures.
+//
+type recorder struct {
+	path    string
+	maxSize int64
+	files   int
+
+	// nil after a failed rotate until the next record opens it again
+	file   *os.File
+	size   int64
+	closed bool
+
+	log  loggo.Logger
+	lock sync.Mutex
+}
+
+// Opens the capture file for appending, maxSize is in bytes.
+func createRecorder(path string, maxSize int64, files int) (*recorder, error) {
+
+	r := &recorder{path: path, maxSize: maxSize, files: files, log: loggo.GetLogger("capture")}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *recorder) open() error {
+
+	// payloads aren't redacted, so keep them from other users
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+
+	return nil
+}
+
+// Writes the message to the capture, failures are logged rather than getting in
+// the way of the bridge.
+func (r *recorder) record(tag string, msg *bridgeMessage, updated string, now time.Time) {
+
+	line, err := json.Marshal(&captureRecord{Time: now, Direction: tag, Topic: msg.topic, Updated: updated, Payload: msg.payload})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			r.log.Warningf("Dropped a %s message, unable to open the capture %s", tag, err)
+			return
+		}
+	}
+
+	if r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			r.log.Warningf("Dropped a %s message, unable to rotate the capture %s", tag, err)
+			return
+		}
+	}
+
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+
+	if err != nil {
+		r.log.Warningf("Unable to write the capture %s", err)
+	}
+}
+
+// Shifts the older captures along, dropping the oldest, and starts a new file.
+func (r *recorder) rotate() error {
+
+	r.file.Close()
+	r.file = nil
+
+	if r.files > 0 {
+		for i := r.files - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+func (r *recorder) close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = true
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Which records to replay and how.
+type replayOptions struct {
+	// 1 for the original timing, 2 for twice as fast, 0 for no waiting at all
+	speed float64
+
+	// only replay records from this direction, all of them when empty
+	direction string
+
+	// publish on the topic the bridge rewrote the message to
+	rewritten bool
+}
+
+// Publishes each record read from in on the client, waiting between them as long
+// as they were apart when captured divided by the speed. Returns how many were
+// published.
+func replayCapture(client mqttClient, in io.Reader, opts replayOptions, sleep func(time.Duration)) (int, error) {
+
+	decoder := json.NewDecoder(in)
+
+	var last time.Time
+	count := 0
+
+	for {
+		rec := &captureRecord{}
+
+		if err := decoder.Decode(rec); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, fmt.Errorf("Bad capture record %s", err)
+		}
+
+		if opts.direction != "" && rec.Direction != opts.direction {
+			continue
+		}
+
+		if opts.speed > 0 && !last.IsZero() && rec.Time.After(last) {
+			sleep(time.Duration(float64(rec.Time.Sub(last)) / opts.speed))
+		}
+		last = rec.Time
+
+		topic := rec.Topic
+		if opts.rewritten {
+			topic = rec.Updated
+		}
+
+		if err := client.publish(topic, rec.Payload); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+}
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/cli"
+	. "launchpad.net/gocheck"
+)
+
+type LoadCaptureSuite struct {
+	dir  string
+	path string
+}
+
+var _ = Suite(&LoadCaptureSuite{})
+
+func (s *LoadCaptureSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.path = filepath.Join(s.dir, "capture.json")
+}
+
+// Decodes every record in a capture file.
+func readRecords(c *C, path string) []*captureRecord {
+
+	file, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer file.Close()
+
+	records := []*captureRecord{}
+	decoder := json.NewDecoder(file)
+
+	for {
+		rec := &captureRecord{}
+		err := decoder.Decode(rec)
+		if err == io.EOF {
+			return records
+		}
+		c.Assert(err, IsNil)
+		records = append(records, rec)
+	}
+}
+
+func (s *LoadCaptureSuite) TestRecord(c *C) {
+
+	recorder, err := createRecorder(s.path, 1024*1024, 3)
+	c.Assert(err, IsNil)
+	defer recorder.close()
+
+	local := createFakeBroker()
+	cloud := createFakeBroker()
+
+	bridge := createBridge(&Config{LocalUrl: fakeLocalUrl, SerialNo: "1234", recorder: recorder})
+	bridge.newClient = fakeClients(map[string]*fakeBroker{fakeLocalUrl: local, fakeCloudUrl: cloud})
+	bridge.reconnectDelay = time.Hour
+
+	c.Assert(bridge.start(fakeCloudUrl, "capture-token"), IsNil)
+	defer bridge.stop()
+
+	local.publish("$device/a/channel/b", []byte(`{"params":[1]}`))
+	cloud.publish("$cloud/device/a/channel/b/reply", []byte(`{"result":true}`))
+
+	// matches no rule so isn't bridged
+	local.publish("$nothing/here", []byte(`{}`))
+
+	records := readRecords(c, s.path)
+	c.Assert(records, HasLen, 3)
+
+	c.Assert(records[0].Direction, Equals, "local")
+	c.Assert(records[0].Topic, Equals, "$device/a/channel/b")
+	c.Assert(records[0].Updated, Equals, "$cloud/device/a/channel/b")
+	c.Assert(string(records[0].Payload), Equals, `{"params":[1]}`)
+	c.Assert(records[0].Time.IsZero(), Equals, false)
+
+	c.Assert(records[1].Direction, Equals, "cloud")
+	c.Assert(records[1].Topic, Equals, "$cloud/device/a/channel/b/reply")
+	c.Assert(records[1].Updated, Equals, "$device/a/channel/b/reply")
+	c.Assert(string(records[1].Payload), Equals, `{"result":true}`)
+
+	// the reply is also sent up on the remote device topic, as the cloud tagged it
+	c.Assert(records[2].Direction, Equals, "local")
+	c.Assert(records[2].Updated, Equals, "$cloud/remote_device/a/channel/b/reply")
+	c.Assert(string(records[2].Payload), Equals, `{"$mesh-source":"cloud-cloud:8883", "$mesh-trace":"`+traceOf(records[2].Payload)+`", "result":true}`)
+
+	info, err := os.Stat(s.path)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+}
+
+func (s *LoadCaptureSuite) TestRotate(c *C) {
+
+	recorder, err := createRecorder(s.path, 300, 2)
+	c.Assert(err, IsNil)
+	defer recorder.close()
+
+	now := time.Now()
+
+	for i := 0; i < 12; i++ {
+		recorder.record("local", &bridgeMessage{topic: "$device/a/channel/b", payload: bytes.Repeat([]byte("x"), 40)}, "$cloud/device/a/channel/b", now)
+	}
+
+	for _, name := range []string{s.path, s.path + ".1", s.path + ".2"} {
+		info, err := os.Stat(name)
+		c.Assert(err, IsNil)
+		c.Assert(info.Size() <= 300, Equals, true, Commentf("%s is %d bytes", name, info.Size()))
+		c.Assert(len(readRecords(c, name)) > 0, Equals, true)
+	}
+
+	_, err = os.Stat(s.path + ".3")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// picks up where it left off after a restart
+	recorder.close()
+	info, err := os.Stat(s.path)
+	c.Assert(err, IsNil)
+
+	recorder, err = createRecorder(s.path, 300, 2)
+	c.Assert(err, IsNil)
+	c.Assert(recorder.size, Equals, info.Size())
+}
+
+func (s *LoadCaptureSuite) TestRotateFails(c *C) {
+
+	recorder, err := createRecorder(s.path, 100, 1)
+	c.Assert(err, IsNil)
+	defer recorder.close()
+
+	msg := &bridgeMessage{topic: "$device/a/channel/b", payload: []byte(`{}`)}
+	recorder.record("local", msg, "$cloud/device/a/channel/b", time.Now())
+
+	// a directory in the way stops the rename, the message is dropped
+	blocked := filepath.Join(s.path+".1", "blocked")
+	c.Assert(os.MkdirAll(blocked, 0700), IsNil)
+	recorder.record("local", msg, "$cloud/device/a/channel/b", time.Now())
+
+	// then picked up again once the way is clear
+	c.Assert(os.RemoveAll(s.path+".1"), IsNil)
+	recorder.record("local", msg, "$cloud/device/a/channel/b", time.Now())
+
+	c.Assert(readRecords(c, s.path+".1"), HasLen, 1)
+	c.Assert(readRecords(c, s.path), HasLen, 1)
+
+	// nothing is written once closed
+	recorder.close()
+	recorder.record("local", msg, "$cloud/device/a/channel/b", time.Now())
+	c.Assert(readRecords(c, s.path), HasLen, 1)
+}
+
+func (s *LoadCaptureSuite) TestReplay(c *C) {
+
+	start := time.Date(2014, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	capture := &bytes.Buffer{}
+	encoder := json.NewEncoder(capture)
+	encoder.Encode(&captureRecord{Time: start, Direction: "local", Topic: "$device/a/channel/b", Updated: "$cloud/device/a/channel/b", Payload: []byte(`{"n":1}`)})
+	encoder.Encode(&captureRecord{Time: start.Add(time.Second), Direction: "cloud", Topic: "$cloud/device/a/channel/b/reply", Updated: "$device/a/channel/b/reply", Payload: []byte(`{"n":2}`)})
+	encoder.Encode(&captureRecord{Time: start.Add(3 * time.Second), Direction: "local", Topic: "$device/a/channel/c", Updated: "$cloud/device/a/channel/c", Payload: []byte{0, 1, 2}})
+
+	broker := createFakeBroker()
+	client := fakeClients(map[string]*fakeBroker{fakeLocalUrl: broker})(&clientOptions{server: fakeLocalUrl})
+	c.Assert(client.connect(), IsNil)
+
+	slept := []time.Duration{}
+	sleep := func(d time.Duration) { slept = append(slept, d) }
+
+	// twice as fast
+	count, err := replayCapture(client, bytes.NewReader(capture.Bytes()), replayOptions{speed: 2}, sleep)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 3)
+	c.Assert(slept, DeepEquals, []time.Duration{500 * time.Millisecond, time.Second})
+
+	c.Assert(broker.publishedOn("$device/a/channel/b"), HasLen, 1)
+	c.Assert(broker.publishedOn("$cloud/device/a/channel/b/reply"), HasLen, 1)
+	c.Assert(broker.publishedOn("$device/a/channel/c")[0].payload, DeepEquals, []byte{0, 1, 2})
+
+	// one direction, on the rewritten topics, without waiting
+	slept = []time.Duration{}
+	count, err = replayCapture(client, bytes.NewReader(capture.Bytes()), replayOptions{direction: "local", rewritten: true}, sleep)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+	c.Assert(slept, HasLen, 0)
+	c.Assert(broker.publishedOn("$cloud/device/a/channel/+"), HasLen, 2)
+
+	_, err = replayCapture(client, strings.NewReader(`{"time":"yesterday"}`), replayOptions{}, sleep)
+	c.Assert(err, ErrorMatches, "Bad capture record .*")
+}
+
+func (s *LoadCaptureSuite) TestReplayCommand(c *C) {
+
+	recorder, err := createRecorder(s.path, 1024, 1)
+	c.Assert(err, IsNil)
+	recorder.record("local", &bridgeMessage{topic: "$device/a/channel/b", payload: []byte(`{}`)}, "$cloud/device/a/channel/b", time.Now())
+	recorder.record("local", &bridgeMessage{topic: "$device/a/channel/b", payload: []byte(`{}`)}, "$cloud/device/a/channel/b", time.Now())
+	recorder.close()
+
+	broker := createFakeBroker()
+	out := &bytes.Buffer{}
+	command := &ReplayCommand{Ui: &cli.BasicUi{Writer: out}, newClient: fakeClients(map[string]*fakeBroker{"tcp://test:1883": broker})}
+
+	c.Assert(command.Run([]string{"-url", "tcp://test:1883", "-speed", "0", s.path}), Equals, exitOk)
+	c.Assert(out.String(), Equals, "replayed 2 messages\n")
+	c.Assert(broker.publishedOn("$device/a/channel/b"), HasLen, 2)
+
+	c.Assert(command.Run([]string{"-url", "tcp://test:1883", "-direction", "sideways", s.path}), Equals, exitFailed)
+	c.Assert(command.Run([]string{"-url", "tcp://test:1883"}), Equals, exitFailed)
+
+	missing := filepath.Join(s.dir, "missing.json")
+	c.Assert(command.Run([]string{"-url", "tcp://test:1883", missing}), Equals, exitFailed)
+
+	garbled := filepath.Join(s.dir, "garbled.json")
+	c.Assert(ioutil.WriteFile(garbled, []byte("not json"), 0600), IsNil)
+	c.Assert(command.Run([]string{"-url", "tcp://test:1883", garbled}), Equals, exitFailed)
+	c.Assert(out.String(), Matches, "(?s).*Unable to replay .*garbled.json Bad capture record.*")
+
+	// a broker that isn't there
+	broker.refuse(ErrNotConnected)
+	c.Assert(command.Run([]string{"-url", "tcp://test:1883", s.path}), Equals, exitFailed)
+}
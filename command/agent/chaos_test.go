@@ -0,0 +1,451 @@
+package agent
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+//
+// A TCP proxy which sits between the bridge and a test broker and misbehaves on
+// request. It understands just enough MQTT to hold back the CONNACK or answer a
+// CONNECT itself, everything else is passed through packet by packet.
+//
+type chaosProxy struct {
+	addr     string
+	target   string
+	listener net.Listener
+
+	conns    map[net.Conn]bool
+	accepted []time.Time
+
+	// faults, off when zero
+	refuse       bool
+	reject       bool
+	blackhole    bool
+	connackDelay time.Duration
+
+	lock sync.Mutex
+}
+
+func startProxy(c *C, target string) *chaosProxy {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	proxy := &chaosProxy{addr: listener.Addr().String(), target: target, listener: listener, conns: make(map[net.Conn]bool)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.serve(conn)
+		}
+	}()
+
+	return proxy
+}
+
+func (p *chaosProxy) url() string {
+	return "tcp://" + p.addr
+}
+
+func (p *chaosProxy) close() {
+	p.listener.Close()
+	p.dropConnections()
+}
+
+// Closes every proxied connection in both directions.
+func (p *chaosProxy) dropConnections() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for conn := range p.conns {
+		conn.Close()
+		delete(p.conns, conn)
+	}
+}
+
+// Accepts connections then closes them straight away.
+func (p *chaosProxy) setRefuse(refuse bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.refuse = refuse
+}
+
+// Answers every CONNECT with bad credentials.
+func (p *chaosProxy) setReject(reject bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.reject = reject
+}
+
+// Silently discards traffic both ways, connections stay open.
+func (p *chaosProxy) setBlackhole(blackhole bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.blackhole = blackhole
+}
+
+// Holds back the broker's CONNACK for a while.
+func (p *chaosProxy) delayConnack(delay time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.connackDelay = delay
+}
+
+// When each connection was accepted.
+func (p *chaosProxy) attempts() []time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]time.Time{}, p.accepted...)
+}
+
+func (p *chaosProxy) serve(client net.Conn) {
+
+	p.lock.Lock()
+	p.accepted = append(p.accepted, time.Now())
+	refuse, reject := p.refuse, p.reject
+	p.lock.Unlock()
+
+	if refuse {
+		client.Close()
+		return
+	}
+
+	if reject {
+		reader := bufio.NewReader(client)
+		if header, _, err := readPacket(reader); err == nil && header>>4 == packetConnect {
+			writePacket(client, packetConnack<<4, []byte{0, connBadCredentials})
+		}
+		client.Close()
+		return
+	}
+
+	broker, err := net.Dial("tcp", p.target)
+
+	if err != nil {
+		client.Close()
+		return
+	}
+
+	p.lock.Lock()
+	p.conns[client] = true
+	p.conns[broker] = true
+	p.lock.Unlock()
+
+	go p.pump(broker, client, true)
+	p.pump(client, broker, false)
+}
+
+// Copies packets from src to dst until either side closes, then closes both.
+func (p *chaosProxy) pump(src net.Conn, dst net.Conn, fromBroker bool) {
+
+	defer func() {
+		src.Close()
+		dst.Close()
+	}()
+
+	reader := bufio.NewReader(src)
+	first := true
+
+	for {
+		header, body, err := readPacket(reader)
+
+		if err != nil {
+			return
+		}
+
+		p.lock.Lock()
+		blackhole, delay := p.blackhole, p.connackDelay
+		p.lock.Unlock()
+
+		if blackhole {
+			continue
+		}
+
+		if fromBroker && first && header>>4 == packetConnack {
+			time.Sleep(delay)
+		}
+		first = false
+
+		if writePacket(dst, header, body) != nil {
+			return
+		}
+	}
+}
+
+// Runs the bridge with its cloud leg going through the chaos proxy.
+type LoadChaosSuite struct {
+	local  *testBroker
+	cloud  *testBroker
+	proxy  *chaosProxy
+	bridge *Bridge
+}
+
+var _ = Suite(&LoadChaosSuite{})
+
+const chaosReconnectDelay = 200 * time.Millisecond
+
+func (s *LoadChaosSuite) SetUpTest(c *C) {
+	s.local = startBroker(c)
+	s.cloud = startBroker(c)
+	s.proxy = startProxy(c, s.cloud.addr)
+
+	s.bridge = createBridge(&Config{LocalUrl: s.local.url(), SerialNo: "1234"})
+	s.bridge.reconnectDelay = chaosReconnectDelay
+	s.bridge.connectTimeout = 500 * time.Millisecond
+	s.bridge.keepAlive = 1
+	s.bridge.eventCh = make(chan bridgeEvent, 10)
+}
+
+func (s *LoadChaosSuite) TearDownTest(c *C) {
+	if s.bridge.flags().Configured {
+		s.returns(c, time.Second, func() { s.bridge.stop() })
+	}
+	s.proxy.close()
+	s.local.close()
+	s.cloud.close()
+}
+
+// Fails unless f returns within the limit, so a deadlock fails the test instead of
+// hanging it.
+func (s *LoadChaosSuite) returns(c *C, limit time.Duration, f func()) time.Duration {
+	done := make(chan bool)
+	started := time.Now()
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(limit):
+		c.Fatalf("still blocked after %s", limit)
+	}
+	return time.Since(started)
+}
+
+func (s *LoadChaosSuite) start(c *C, token string) (err error) {
+	s.returns(c, 2*time.Second, func() { err = s.bridge.start(s.proxy.url(), token) })
+	return err
+}
+
+func (s *LoadChaosSuite) waitBridged(c *C) {
+	c.Assert(s.cloud.waitSubscribed("$cloud/device/+/channel/+/reply"), IsNil)
+	c.Assert(s.local.wait(s.bridge.IsConnected), IsNil)
+}
+
+func (s *LoadChaosSuite) waitDisconnected(c *C) {
+	c.Assert(s.local.wait(func() bool { return !s.bridge.IsConnected() }), IsNil)
+}
+
+// Checks the bridge still moves messages both ways.
+func (s *LoadChaosSuite) checkForwarding(c *C) {
+	s.local.publish("$device/chaos/channel/check", []byte(`{}`))
+	_, err := s.cloud.waitPublished("$cloud/device/chaos/channel/check")
+	c.Assert(err, IsNil)
+
+	s.cloud.publish("$cloud/device/chaos/channel/check/reply", []byte(`{}`))
+	_, err = s.local.waitPublished("$device/chaos/channel/check/reply")
+	c.Assert(err, IsNil)
+}
+
+// Checks consecutive attempts were spaced by the reconnect delay.
+func checkSpacing(c *C, attempts []time.Time) {
+	for i := 1; i < len(attempts); i++ {
+		gap := attempts[i].Sub(attempts[i-1])
+		c.Check(gap >= chaosReconnectDelay, Equals, true, Commentf("attempt %d after %s", i, gap))
+		c.Check(gap < chaosReconnectDelay+time.Second, Equals, true, Commentf("attempt %d after %s", i, gap))
+	}
+}
+
+func (s *LoadChaosSuite) TestDroppedConnection(c *C) {
+
+	c.Assert(s.start(c, "chaos-token"), IsNil)
+	s.waitBridged(c)
+
+	dropped := time.Now()
+	s.proxy.dropConnections()
+
+	s.waitDisconnected(c)
+	c.Assert(s.bridge.flags().Configured, Equals, true)
+
+	s.waitBridged(c)
+	c.Assert(s.bridge.flags().LastError, IsNil)
+
+	attempts := s.proxy.attempts()
+	c.Assert(attempts, HasLen, 2)
+	c.Assert(attempts[1].Sub(dropped) >= chaosReconnectDelay, Equals, true)
+
+	// the old connections were closed, not leaked
+	c.Assert(s.local.wait(func() bool { return s.local.clients() == 1 && s.cloud.clients() == 1 }), IsNil)
+
+	s.checkForwarding(c)
+}
+
+func (s *LoadChaosSuite) TestRepeatedFailures(c *C) {
+
+	c.Assert(s.start(c, "chaos-token"), IsNil)
+	s.waitBridged(c)
+
+	s.proxy.setRefuse(true)
+	s.proxy.dropConnections()
+
+	// keeps trying at the reconnect delay while the cloud is unreachable
+	c.Assert(s.local.wait(func() bool { return len(s.proxy.attempts()) >= 5 }), IsNil)
+	c.Assert(s.bridge.IsConnected(), Equals, false)
+	c.Assert(s.bridge.flags().LastError, NotNil)
+	c.Assert(s.bridge.flags().CredentialsRequired, Equals, false)
+
+	s.proxy.setRefuse(false)
+	s.waitBridged(c)
+
+	checkSpacing(c, s.proxy.attempts()[1:])
+	s.checkForwarding(c)
+}
+
+func (s *LoadChaosSuite) TestBlackhole(c *C) {
+
+	c.Assert(s.start(c, "chaos-token"), IsNil)
+	s.waitBridged(c)
+
+	// pings go unanswered, and so do the connects which follow. The ping itself counts
+	// as contact, so paho takes two to three keep alive periods to give up
+	s.proxy.setBlackhole(true)
+	c.Assert(waitFor(func() bool { return !s.bridge.IsConnected() }, 10*time.Second), Equals, true)
+
+	c.Assert(s.local.wait(func() bool { return len(s.proxy.attempts()) >= 3 }), IsNil)
+	c.Assert(s.bridge.IsConnected(), Equals, false)
+
+	s.proxy.setBlackhole(false)
+	s.proxy.dropConnections()
+	s.waitBridged(c)
+
+	s.checkForwarding(c)
+}
+
+func (s *LoadChaosSuite) TestSlowConnack(c *C) {
+
+	s.proxy.delayConnack(200 * time.Millisecond)
+
+	started := time.Now()
+	c.Assert(s.start(c, "chaos-token"), IsNil)
+	c.Assert(time.Since(started) >= 200*time.Millisecond, Equals, true)
+	s.waitBridged(c)
+
+	s.proxy.delayConnack(time.Minute)
+	s.proxy.dropConnections()
+	s.waitDisconnected(c)
+
+	// each attempt gives up at the connect timeout and is retried
+	c.Assert(s.local.wait(func() bool { return len(s.proxy.attempts()) >= 3 }), IsNil)
+	c.Assert(s.bridge.IsConnected(), Equals, false)
+
+	s.proxy.delayConnack(0)
+	s.waitBridged(c)
+
+	s.checkForwarding(c)
+}
+
+func (s *LoadChaosSuite) TestConnackNeverArrives(c *C) {
+
+	s.proxy.delayConnack(time.Minute)
+
+	elapsed := s.returns(c, 2*time.Second, func() {
+		c.Assert(s.bridge.start(s.proxy.url(), "chaos-token"), Equals, ErrConnectTimeout)
+	})
+	c.Assert(elapsed < time.Second, Equals, true)
+
+	c.Assert(s.bridge.flags().Configured, Equals, true)
+	c.Assert(s.bridge.flags().LastError, Equals, ErrConnectTimeout)
+
+	// stopping while a reconnect is stalled
+	c.Assert(s.local.wait(func() bool { return len(s.proxy.attempts()) >= 2 }), IsNil)
+	s.returns(c, 2*time.Second, func() { c.Assert(s.bridge.stop(), IsNil) })
+
+	// nothing is retried once stopped
+	time.Sleep(time.Second)
+	attempts := len(s.proxy.attempts())
+	time.Sleep(2 * chaosReconnectDelay)
+	c.Assert(s.proxy.attempts(), HasLen, attempts)
+}
+
+func (s *LoadChaosSuite) TestConnackAfterStop(c *C) {
+
+	s.bridge.connectTimeout = 2 * time.Second
+
+	c.Assert(s.start(c, "chaos-token"), IsNil)
+	s.waitBridged(c)
+
+	// the reconnect is still waiting on the cloud when the bridge is stopped
+	s.proxy.delayConnack(500 * time.Millisecond)
+	s.proxy.dropConnections()
+
+	c.Assert(s.local.wait(func() bool { return len(s.proxy.attempts()) >= 2 }), IsNil)
+	s.returns(c, time.Second, func() { c.Assert(s.bridge.stop(), IsNil) })
+
+	// the late connection is closed rather than bridged
+	time.Sleep(time.Second)
+	c.Assert(s.bridge.IsConnected(), Equals, false)
+	c.Assert(s.bridge.flags().Connected, Equals, false)
+	c.Assert(s.local.wait(func() bool { return s.local.clients() == 0 && s.cloud.clients() == 0 }), IsNil)
+
+	attempts := len(s.proxy.attempts())
+	time.Sleep(2 * chaosReconnectDelay)
+	c.Assert(s.proxy.attempts(), HasLen, attempts)
+}
+
+func (s *LoadChaosSuite) TestRejectedCredentials(c *C) {
+
+	c.Assert(s.start(c, "chaos-token"), IsNil)
+	s.waitBridged(c)
+
+	s.proxy.setReject(true)
+	s.proxy.dropConnections()
+
+	select {
+	case ev := <-s.bridge.eventCh:
+		c.Assert(ev.topic, Equals, credentialsRequiredTopic)
+	case <-time.After(brokerWait):
+		c.Fatal("no credentials required event")
+	}
+
+	c.Assert(s.bridge.flags().CredentialsRequired, Equals, true)
+	c.Assert(s.bridge.flags().LastError, Equals, ErrBadCredentials)
+
+	// no retries with a rejected token
+	attempts := len(s.proxy.attempts())
+	time.Sleep(3 * chaosReconnectDelay)
+	c.Assert(s.proxy.attempts(), HasLen, attempts)
+
+	s.proxy.setReject(false)
+	s.returns(c, 2*time.Second, func() { c.Assert(s.bridge.reconfigure("", "chaos-fresh-token"), IsNil) })
+	s.waitBridged(c)
+
+	c.Assert(s.cloud.lastConnect().username, Equals, "chaos-fresh-token")
+	c.Assert(s.bridge.flags().CredentialsRequired, Equals, false)
+
+	s.checkForwarding(c)
+}
+
+func (s *LoadChaosSuite) TestFlapping(c *C) {
+
+	c.Assert(s.start(c, "chaos-token"), IsNil)
+	s.waitBridged(c)
+
+	// drops faster than the bridge can settle
+	for i := 0; i < 10; i++ {
+		s.proxy.dropConnections()
+		time.Sleep(chaosReconnectDelay / 3)
+	}
+
+	s.waitBridged(c)
+	c.Assert(s.local.wait(func() bool { return s.local.clients() == 1 && s.cloud.clients() == 1 }), IsNil)
+
+	s.checkForwarding(c)
+}
@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+var ErrBadCredentials = errors.New("Bad user name or password")
+var ErrNotAuthorized = errors.New("Not Authorized")
+var ErrNotConnected = errors.New("Not Connected")
+var ErrConnectTimeout = errors.New("Timed out waiting for the broker to accept the connection")
+
+//
+// The little of an MQTT client the bridge and bus need, so they can be tested
+// against a fake and aren't tied to one client library.
+//
+// A rejected connect returns ErrBadCredentials or ErrNotAuthorized whatever the
+// library underneath, so callers can tell a bad token from a broken network.
+//
+type mqttClient interface {
+	connect() error
+
+	// handler may be nil, in which case the options' onMessage gets the messages
+	subscribe(filter string, handler messageHandler) error
+	unsubscribe(filters ...string) error
+
+	publish(topic string, payload []byte) error
+
+	isConnected() bool
+	disconnect()
+}
+
+// Called with the client a message arrived on.
+type messageHandler func(client mqttClient, msg *bridgeMessage)
+
+type clientOptions struct {
+	server   string
+	clientId string
+	username string
+
+	tls       *tls.Config
+	keepAlive uint
+
+	// how long connect waits for the broker to answer, zero waits forever
+	connectTimeout time.Duration
+
+	// receives messages for subscriptions without a handler of their own
+	onMessage messageHandler
+
+	// called once when an established connection fails
+	onConnectionLost func(client mqttClient, reason error)
+}
+
+// Builds an unconnected client.
+type clientFactory func(opts *clientOptions) mqttClient
+
+// Adapts the paho client to mqttClient.
+type pahoClient struct {
+	client         *mqtt.MqttClient
+	connectTimeout time.Duration
+
+	// set once connected, and once the connection has been lost or abandoned
+	established bool
+	closed      bool
+	lock        sync.Mutex
+}
+
+func newPahoClient(opts *clientOptions) mqttClient {
+
+	c := &pahoClient{connectTimeout: opts.connectTimeout}
+
+	pahoOpts := mqtt.NewClientOptions().AddBroker(opts.server).SetClientId(opts.clientId)
+
+	if opts.tls != nil {
+		pahoOpts.SetTlsConfig(opts.tls)
+	}
+
+	if opts.username != "" {
+		pahoOpts.SetUsername(opts.username)
+	}
+
+	if opts.keepAlive > 0 {
+		pahoOpts.SetKeepAlive(opts.keepAlive)
+	}
+
+	if opts.onMessage != nil {
+		pahoOpts.SetDefaultPublishHandler(c.handler(opts.onMessage))
+	}
+
+	if opts.onConnectionLost != nil {
+		pahoOpts.SetOnConnectionLost(func(_ *mqtt.MqttClient, reason error) {
+			if c.lost() {
+				opts.onConnectionLost(c, reason)
+			}
+		})
+	}
+
+	c.client = mqtt.NewClient(pahoOpts)
+
+	return c
+}
+
+// paho has no connect timeout, so Start runs in the background and is abandoned if
+// the broker doesn't answer in time. Should the broker answer later the connection
+// is closed again.
+func (c *pahoClient) connect() error {
+
+	result := make(chan error, 1)
+
+	go func() {
+		_, err := c.client.Start()
+		result <- err
+	}()
+
+	var timeout <-chan time.Time
+	if c.connectTimeout > 0 {
+		timeout = time.After(c.connectTimeout)
+	}
+
+	var err error
+
+	select {
+	case err = <-result:
+	case <-timeout:
+		c.lock.Lock()
+		c.closed = true
+		c.lock.Unlock()
+
+		go func() {
+			if <-result == nil {
+				c.client.Disconnect(0)
+			}
+		}()
+		return ErrConnectTimeout
+	}
+
+	if err == nil {
+		c.lock.Lock()
+		c.established = true
+		c.lock.Unlock()
+	}
+
+	switch err {
+	case mqtt.ErrBadCredentials:
+		return ErrBadCredentials
+	case mqtt.ErrNotAuthorized:
+		return ErrNotAuthorized
+	case mqtt.ErrNotConnected:
+		return ErrNotConnected
+	}
+
+	return err
+}
+
+// Waits for the broker to acknowledge the subscription.
+func (c *pahoClient) subscribe(filter string, handler messageHandler) error {
+
+	topicFilter, err := mqtt.NewTopicFilter(filter, 0)
+
+	if err != nil {
+		return err
+	}
+
+	// a nil callback registers no route, leaving the message to the default handler
+	var callback mqtt.MessageHandler
+	if handler != nil {
+		callback = c.handler(handler)
+	}
+
+	receipt, err := c.client.StartSubscription(callback, topicFilter)
+
+	if err == mqtt.ErrNotConnected {
+		return ErrNotConnected
+	}
+
+	if err != nil {
+		return err
+	}
+
+	<-receipt
+
+	return nil
+}
+
+func (c *pahoClient) unsubscribe(filters ...string) error {
+
+	_, err := c.client.EndSubscription(filters...)
+
+	if err == mqtt.ErrNotConnected {
+		return ErrNotConnected
+	}
+
+	return err
+}
+
+func (c *pahoClient) publish(topic string, payload []byte) error {
+
+	if !c.isConnected() {
+		return ErrNotConnected
+	}
+
+	c.client.PublishMessage(topic, mqtt.NewMessage(payload))
+
+	return nil
+}
+
+func (c *pahoClient) isConnected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return !c.closed && c.client.IsConnected()
+}
+
+func (c *pahoClient) disconnect() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// paho tears down a lost connection itself, disconnecting it again panics
+	if !c.closed && c.client.IsConnected() {
+		c.client.Disconnect(100)
+	}
+	c.closed = true
+}
+
+// Marks an established connection as lost, reporting whether it was still open. paho
+// also reports failed connects as lost connections, those aren't passed on.
+func (c *pahoClient) lost() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	open := c.established && !c.closed
+	c.closed = true
+	return open
+}
+
+func (c *pahoClient) handler(handler messageHandler) mqtt.MessageHandler {
+	return func(_ *mqtt.MqttClient, received mqtt.Message) {
+		handler(c, &bridgeMessage{topic: received.Topic(), payload: received.Payload(), size: len(received.Bytes())})
+	}
+}
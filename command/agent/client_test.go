@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+// Runs the paho adapter against the in-process broker.
+type LoadClientSuite struct {
+	broker *testBroker
+}
+
+var _ = Suite(&LoadClientSuite{})
+
+func (s *LoadClientSuite) SetUpTest(c *C) {
+	s.broker = startBroker(c)
+}
+
+func (s *LoadClientSuite) TearDownTest(c *C) {
+	s.broker.close()
+}
+
+func (s *LoadClientSuite) TestHandlers(c *C) {
+
+	defaults := make(chan *bridgeMessage, 10)
+	replies := make(chan *bridgeMessage, 10)
+
+	client := newPahoClient(&clientOptions{
+		server:   s.broker.url(),
+		clientId: "client-test",
+		username: "client-test-user",
+		onMessage: func(_ mqttClient, msg *bridgeMessage) {
+			defaults <- msg
+		},
+	})
+
+	c.Assert(client.publish("$device/a", []byte(`{}`)), Equals, ErrNotConnected)
+
+	c.Assert(client.connect(), IsNil)
+	defer client.disconnect()
+
+	c.Assert(client.isConnected(), Equals, true)
+	c.Assert(s.broker.lastConnect().username, Equals, "client-test-user")
+
+	c.Assert(client.subscribe("$device/#", nil), IsNil)
+	c.Assert(client.subscribe("$sphere/reply", func(src mqttClient, msg *bridgeMessage) {
+		c.Check(src, Equals, client)
+		replies <- msg
+	}), IsNil)
+
+	s.broker.publish("$device/a", []byte(`{"a":1}`))
+	s.broker.publish("$sphere/reply", []byte(`{"b":2}`))
+
+	msg := receive(c, defaults)
+	c.Assert(msg.topic, Equals, "$device/a")
+	c.Assert(string(msg.payload), Equals, `{"a":1}`)
+	c.Assert(msg.size > len(msg.payload), Equals, true)
+
+	msg = receive(c, replies)
+	c.Assert(msg.topic, Equals, "$sphere/reply")
+
+	c.Assert(client.publish("$cloud/device/a", []byte(`{"c":3}`)), IsNil)
+	published, err := s.broker.waitPublished("$cloud/device/a")
+	c.Assert(err, IsNil)
+	c.Assert(published.clientId, Equals, "client-test")
+
+	c.Assert(client.unsubscribe("$device/#"), IsNil)
+	c.Assert(s.broker.wait(func() bool { return !s.broker.subscribed("$device/#") }), IsNil)
+}
+
+func (s *LoadClientSuite) TestRejected(c *C) {
+
+	s.broker.authenticate = func(clientId string, username string) byte {
+		if username == "client-test-rejected" {
+			return connBadCredentials
+		}
+		return connNotAuthorized
+	}
+
+	// without a handler paho exits the process on a refused connect
+	ignore := func(mqttClient, error) {}
+
+	client := newPahoClient(&clientOptions{server: s.broker.url(), clientId: "a", username: "client-test-rejected", onConnectionLost: ignore})
+	c.Assert(client.connect(), Equals, ErrBadCredentials)
+
+	client = newPahoClient(&clientOptions{server: s.broker.url(), clientId: "b", onConnectionLost: ignore})
+	c.Assert(client.connect(), Equals, ErrNotAuthorized)
+}
+
+func (s *LoadClientSuite) TestConnectionLost(c *C) {
+
+	lost := make(chan mqttClient, 1)
+
+	client := newPahoClient(&clientOptions{
+		server:   s.broker.url(),
+		clientId: "client-test",
+		onConnectionLost: func(client mqttClient, reason error) {
+			lost <- client
+		},
+	})
+
+	c.Assert(client.connect(), IsNil)
+	c.Assert(s.broker.wait(func() bool { return s.broker.clients() == 1 }), IsNil)
+
+	s.broker.dropConnections()
+
+	select {
+	case src := <-lost:
+		c.Assert(src, Equals, client)
+	case <-time.After(brokerWait):
+		c.Fatal("connection loss not reported")
+	}
+	c.Assert(client.isConnected(), Equals, false)
+}
+
+func receive(c *C, msgs chan *bridgeMessage) *bridgeMessage {
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(brokerWait):
+		c.Fatal("no message received")
+	}
+	return nil
+}
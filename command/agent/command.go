@@ -3,12 +3,12 @@ package agent
 import (
 	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
-	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 	"github.com/hashicorp/logutils"
 	"github.com/juju/loggo"
 	"github.com/mitchellh/cli"
@@ -28,13 +28,46 @@ type Command struct {
 }
 
 type Config struct {
-	Token       string
-	CloudUrl    string
-	LocalUrl    string
-	SerialNo    string
-	Debug       bool
-	Trace       bool
-	StatusTimer int
+	Token        string
+	CloudUrl     string
+	LocalUrl     string
+	SerialNo     string
+	TokenCommand string
+	RedactFields string
+	Rules        string
+	Keys         string
+	LogFormat    string
+	Debug        bool
+	Trace        bool
+	StatusTimer  int
+
+	// control bus authorization
+	ControlSecretFile string
+	ControlSecret     string
+	AllowedHosts      string
+
+	// round trip probes, disabled when the interval is zero
+	ProbeInterval int
+	ProbeTimeout  int
+	ProbeFailures int
+
+	// capture of forwarded messages, disabled when empty
+	Capture      string
+	CaptureSize  int
+	CaptureFiles int
+
+	// local address for health checks, disabled when empty
+	HealthAddr     string
+	ReadyThreshold int
+
+	// loaded from the Rules file, the built in mappings are used when nil
+	rules *ruleSet
+
+	// loaded from the Keys file
+	keys *keyring
+
+	// opened on the Capture file
+	recorder *recorder
 }
 
 func (c *Config) IsDebug() bool {
@@ -47,6 +80,21 @@ func (c *Command) readConfig() *Config {
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.StringVar(&cmdConfig.LocalUrl, "localurl", "tcp://localhost:1883", "cloud url to connect to")
 	cmdFlags.StringVar(&cmdConfig.SerialNo, "serial", "unknown", "the serial number of the device")
+	cmdFlags.StringVar(&cmdConfig.TokenCommand, "token-command", "", "command which prints a new token when the cloud rejects the current one")
+	cmdFlags.StringVar(&cmdConfig.RedactFields, "redact-fields", defaultRedactFields, "comma separated JSON payload fields masked in logs")
+	cmdFlags.StringVar(&cmdConfig.ControlSecretFile, "control-secret-file", "", "file holding the secret control requests must be signed with")
+	cmdFlags.StringVar(&cmdConfig.AllowedHosts, "allowed-hosts", "", "comma separated cloud host patterns control requests may connect to")
+	cmdFlags.StringVar(&cmdConfig.Rules, "rules", "", "JSON file replacing the built in topic rules")
+	cmdFlags.StringVar(&cmdConfig.Keys, "keys", "", "JSON file holding the payload encryption keys")
+	cmdFlags.IntVar(&cmdConfig.ProbeInterval, "probe-interval", 0, "seconds between round trip probes across the bridge, 0 disables them")
+	cmdFlags.IntVar(&cmdConfig.ProbeTimeout, "probe-timeout", 10, "seconds a probe has to make the round trip")
+	cmdFlags.IntVar(&cmdConfig.ProbeFailures, "probe-failures", 3, "probes lost in a row before the bridge reconnects")
+	cmdFlags.StringVar(&cmdConfig.Capture, "capture", "", "file every forwarded message is recorded to, for mqtt-bridgeify replay")
+	cmdFlags.IntVar(&cmdConfig.CaptureSize, "capture-size", 10, "megabytes the capture file may grow to before it is rotated")
+	cmdFlags.IntVar(&cmdConfig.CaptureFiles, "capture-files", 3, "rotated capture files to keep")
+	cmdFlags.StringVar(&cmdConfig.HealthAddr, "health-addr", "", "local address serving /healthz and /readyz, eg. 127.0.0.1:8182")
+	cmdFlags.IntVar(&cmdConfig.ReadyThreshold, "ready-threshold", 30, "seconds the bridge may spend reconnecting before it is reported not ready")
+	cmdFlags.StringVar(&cmdConfig.LogFormat, "log-format", "text", "text, or json for a JSON object per line")
 	cmdFlags.BoolVar(&cmdConfig.Debug, "debug", false, "enable debug")
 	cmdFlags.BoolVar(&cmdConfig.Trace, "trace", false, "enable trace")
 	cmdFlags.IntVar(&cmdConfig.StatusTimer, "status", 30, "time in seconds between status messages")
@@ -55,6 +103,52 @@ func (c *Command) readConfig() *Config {
 		return nil
 	}
 
+	if cmdConfig.ControlSecretFile != "" {
+		secret, err := ioutil.ReadFile(cmdConfig.ControlSecretFile)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to read control secret %s", err))
+			return nil
+		}
+		cmdConfig.ControlSecret = strings.TrimSpace(string(secret))
+	}
+
+	if cmdConfig.Rules != "" {
+		rules, err := loadRules(cmdConfig.Rules, cmdConfig.SerialNo)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to load rules %s", err))
+			return nil
+		}
+		cmdConfig.rules = rules
+	}
+
+	if cmdConfig.Keys != "" {
+		keys, err := loadKeyring(cmdConfig.Keys)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to load keys %s", err))
+			return nil
+		}
+		cmdConfig.keys = keys
+	}
+
+	if cmdConfig.Capture != "" {
+		recorder, err := createRecorder(cmdConfig.Capture, int64(cmdConfig.CaptureSize)*1024*1024, cmdConfig.CaptureFiles)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to open capture %s", err))
+			return nil
+		}
+		cmdConfig.recorder = recorder
+	}
+
+	// mask secrets in everything we log
+	logRedactor.setFields(cmdConfig.RedactFields)
+	logRedactor.addSecret(cmdConfig.ControlSecret)
+	logRedactor.addSecret(cmdConfig.Token)
+	logRedactor.addUrl(cmdConfig.LocalUrl)
+	if err := configureLogging(cmdConfig.LogFormat, os.Stderr); err != nil {
+		c.Ui.Error(fmt.Sprintf("Unable to configure logging %s", err))
+		return nil
+	}
+
 	//if cmdFLags.
 	if cmdConfig.Debug {
 		loggo.GetLogger("").SetLogLevel(loggo.DEBUG)
@@ -62,12 +156,8 @@ func (c *Command) readConfig() *Config {
 		loggo.GetLogger("").SetLogLevel(loggo.INFO)
 	}
 
-	if cmdConfig.Trace {
-		// enable low-level tracing on mqtt library
-		for _, l := range []**log.Logger{&mqtt.DEBUG, &mqtt.ERROR, &mqtt.CRITICAL, &mqtt.WARN} {
-			*l = log.New(os.Stderr, "", 0)
-		}
-	}
+	// enable low-level tracing on mqtt library, it can also be switched on over the bus
+	mqttTrace.setEnabled(cmdConfig.Trace)
 
 	return &cmdConfig
 }
@@ -75,6 +165,7 @@ func (c *Command) readConfig() *Config {
 func (c *Command) handleSignals(config *Config) int {
 	signalCh := make(chan os.Signal, 4)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signalCh)
 	var sig os.Signal
 	select {
 	case s := <-signalCh:
@@ -102,23 +193,60 @@ func (c *Command) Run(args []string) int {
 	}
 	c.args = args
 
+	return c.run(config)
+}
+
+// Runs the agent until a signal or ShutdownCh arrives, then stops the bus, the
+// health server and the capture in that order.
+func (c *Command) run(config *Config) int {
+
+	if config.recorder != nil {
+		// flushes the capture, anything forwarded after this isn't recorded
+		defer config.recorder.close()
+	}
+
 	c.Ui.Output("MQTT bridgeify agent running!")
-	c.Ui.Info("Getting on the bus: " + config.Token)
-	c.Ui.Info("Local url: " + config.LocalUrl)
+	c.Ui.Info("Getting on the bus: " + logRedactor.redact(config.Token))
+	c.Ui.Info("Local url: " + logRedactor.redact(config.LocalUrl))
 
 	c.log = loggo.GetLogger("")
 
 	c.agent = createAgent(config)
 
+	notifier := createNotifier(os.Getenv, os.Getpid())
+
+	if notifier.watchdog > 0 {
+		// systemd restarts us if we hang
+		c.agent.bridge.panicOnHang = false
+	}
+
 	if err := c.agent.start(); err != nil {
 		c.Ui.Error(fmt.Sprintf("error starting agent %s", err))
 	}
 
 	c.bus = createBus(config, c.agent)
+	c.bus.notifier = notifier
+
+	if notifier.enabled() {
+		go notifier.watch(c.agent, c.bus, c.ShutdownCh)
+	}
+
+	if config.HealthAddr != "" {
+		health := createHealthServer(config, c.agent, c.bus)
+		if err := health.start(config.HealthAddr); err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to serve health checks %s", err))
+			return 1
+		}
+		defer health.stop()
+	}
+
+	go c.bus.listen()
+
+	code := c.handleSignals(config)
 
-	c.bus.listen()
+	c.bus.stop()
 
-	return c.handleSignals(config)
+	return code
 }
 
 func (c *Command) Synopsis() string {
@@ -135,6 +263,26 @@ Options:
 
   -localurl=tcp://localhost:1883      URL for the local broker.
   -serial=123123                      Configure the Serial number of the device.
+  -token-command=/path/to/cmd         Command which prints a new token when the
+                                      cloud rejects the current one.
+  -redact-fields=token,password       JSON payload fields masked in logs.
+  -control-secret-file=/path/to/file  Require control requests to be signed with
+                                      the secret held in this file.
+  -allowed-hosts=*.ninjasphere.co     Comma separated cloud host patterns control
+                                      requests may connect to.
+  -rules=/path/to/rules.json          Replace the built in topic rules.
+  -keys=/path/to/keys.json            Payload encryption keys.
+  -probe-interval=30                  Seconds between round trip probes across the
+                                      bridge, off by default.
+  -probe-timeout=10                   Seconds a probe has to make the round trip.
+  -probe-failures=3                   Probes lost in a row before reconnecting.
+  -capture=/path/to/capture.json      Record every forwarded message, see replay.
+  -capture-size=10                    Megabytes before the capture is rotated.
+  -capture-files=3                    Rotated captures to keep.
+  -health-addr=127.0.0.1:8182         Serve /healthz and /readyz on this address.
+  -ready-threshold=30                 Seconds the bridge may spend reconnecting
+                                      before /readyz fails.
+  -log-format=json                    Log a JSON object per line instead of text.
   -debug                              Enables debug output.
 `
 	return helpText
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/cli"
+	. "launchpad.net/gocheck"
+)
+
+type LoadCommandSuite struct{}
+
+var _ = Suite(&LoadCommandSuite{})
+
+func (s *LoadCommandSuite) TestShutdown(c *C) {
+
+	local := startBroker(c)
+	defer local.close()
+
+	recorder, err := createRecorder(filepath.Join(c.MkDir(), "capture"), 1024*1024, 1)
+	c.Assert(err, IsNil)
+
+	// a free port for the health server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	healthAddr := listener.Addr().String()
+	listener.Close()
+
+	shutdownCh := make(chan struct{})
+	command := &Command{Ui: &cli.BasicUi{Writer: &bytes.Buffer{}}, ShutdownCh: shutdownCh}
+	conf := &Config{LocalUrl: local.url(), SerialNo: "1234", HealthAddr: healthAddr, ReadyThreshold: 30, recorder: recorder}
+
+	result := make(chan int)
+	go func() {
+		result <- command.run(conf)
+	}()
+
+	c.Assert(local.waitSubscribed(connectTopic), IsNil)
+
+	close(shutdownCh)
+
+	select {
+	case code := <-result:
+		c.Assert(code, Equals, 0)
+	case <-time.After(brokerWait):
+		c.Fatal("the agent didn't shut down")
+	}
+
+	// the bus has hung up
+	c.Assert(local.wait(func() bool { return local.clients() == 0 }), IsNil)
+
+	// nothing is serving health checks
+	_, err = net.Dial("tcp", healthAddr)
+	c.Assert(err, NotNil)
+
+	recorder.lock.Lock()
+	closed := recorder.closed
+	recorder.lock.Unlock()
+	c.Assert(closed, Equals, true)
+}
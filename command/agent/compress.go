@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	compressGzip    = "gzip"
+	compressDeflate = "deflate"
+)
+
+// refuse to inflate anything beyond this, protects us from compression bombs
+const maxDecompressedSize = 4 << 20
+
+var ErrDecompressedTooLarge = errors.New("Decompressed payload too large")
+
+func validCompression(algorithm string) error {
+	switch algorithm {
+	case compressGzip, compressDeflate:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", algorithm)
+}
+
+// Compressed payloads are published with the algorithm appended as a topic level,
+// eg. $cloud/device/123/channel/456/$gzip
+func compressionSuffix(algorithm string) string {
+	return "/$" + algorithm
+}
+
+// Splits the compression suffix off a topic, algorithm is empty if there was none.
+func splitCompressed(topic string) (base string, algorithm string) {
+	for _, candidate := range []string{compressGzip, compressDeflate} {
+		if strings.HasSuffix(topic, compressionSuffix(candidate)) {
+			return strings.TrimSuffix(topic, compressionSuffix(candidate)), candidate
+		}
+	}
+	return topic, ""
+}
+
+func compressPayload(algorithm string, payload []byte) ([]byte, error) {
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch algorithm {
+	case compressGzip:
+		w = gzip.NewWriter(&buf)
+	case compressDeflate:
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	default:
+		return nil, validCompression(algorithm)
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompressPayload(algorithm string, payload []byte) ([]byte, error) {
+
+	var r io.ReadCloser
+
+	switch algorithm {
+	case compressGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	case compressDeflate:
+		r = flate.NewReader(bytes.NewReader(payload))
+	default:
+		return nil, validCompression(algorithm)
+	}
+
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxDecompressedSize {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	return data, nil
+}
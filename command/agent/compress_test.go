@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadCompressSuite struct {
+	payload []byte
+	bridge  *Bridge
+}
+
+var _ = Suite(&LoadCompressSuite{})
+
+func (s *LoadCompressSuite) SetUpTest(c *C) {
+	s.payload = []byte(`{"params":[` + strings.Repeat(`{"rssi":-72,"name":"tag"},`, 20) + `{}],"jsonrpc":"2.0"}`)
+	s.bridge = createBridge(&Config{})
+}
+
+func (s *LoadCompressSuite) TestRoundTrip(c *C) {
+	for _, algorithm := range []string{compressGzip, compressDeflate} {
+		compressed, err := compressPayload(algorithm, s.payload)
+		c.Assert(err, IsNil)
+		c.Assert(len(compressed) < len(s.payload), Equals, true)
+
+		data, err := decompressPayload(algorithm, compressed)
+		c.Assert(err, IsNil)
+		c.Assert(data, DeepEquals, s.payload)
+	}
+
+	_, err := compressPayload("lzma", s.payload)
+	c.Assert(err, NotNil)
+
+	_, err = decompressPayload(compressGzip, s.payload)
+	c.Assert(err, NotNil)
+}
+
+func (s *LoadCompressSuite) TestTooLarge(c *C) {
+	compressed, err := compressPayload(compressGzip, bytes.Repeat([]byte("a"), maxDecompressedSize+1))
+	c.Assert(err, IsNil)
+
+	_, err = decompressPayload(compressGzip, compressed)
+	c.Assert(err, Equals, ErrDecompressedTooLarge)
+}
+
+func (s *LoadCompressSuite) TestSuffix(c *C) {
+	base, algorithm := splitCompressed("$cloud/device/a/channel/b/$gzip")
+	c.Assert(base, Equals, "$cloud/device/a/channel/b")
+	c.Assert(algorithm, Equals, compressGzip)
+
+	base, algorithm = splitCompressed("$cloud/device/a/channel/b")
+	c.Assert(base, Equals, "$cloud/device/a/channel/b")
+	c.Assert(algorithm, Equals, "")
+}
+
+func (s *LoadCompressSuite) TestCompressOnlyWhenSmaller(c *C) {
+
+	rule := replaceTopic{on: "$device/+/+/rssi", replace: "$device", with: "$cloud/device", compress: compressGzip}
+
+	topic, payload := s.bridge.compress(rule, "$cloud/device/a/b/rssi", s.payload)
+	c.Assert(topic, Equals, "$cloud/device/a/b/rssi/$gzip")
+	c.Assert(len(payload) < len(s.payload), Equals, true)
+	c.Assert(atomic.LoadInt64(&s.bridge.CompressedRawBytes), Equals, int64(len(s.payload)))
+	c.Assert(atomic.LoadInt64(&s.bridge.CompressedBytes), Equals, int64(len(payload)))
+
+	topic, payload = s.bridge.compress(rule, "$cloud/device/a/b/rssi", []byte(`{}`))
+	c.Assert(topic, Equals, "$cloud/device/a/b/rssi")
+	c.Assert(payload, DeepEquals, []byte(`{}`))
+
+	rule.compressMin = len(s.payload) + 1
+	topic, _ = s.bridge.compress(rule, "$cloud/device/a/b/rssi", s.payload)
+	c.Assert(topic, Equals, "$cloud/device/a/b/rssi")
+}
+
+func (s *LoadCompressSuite) TestDecode(c *C) {
+
+	rule := replaceTopic{on: "$cloud/device/+/channel/+/reply", replace: "$cloud/device", with: "$device", compress: compressDeflate}
+	c.Assert(rule.subscriptions("cloud"), DeepEquals, []string{"$cloud/device/+/channel/+/reply", "$cloud/device/+/channel/+/reply/$deflate"})
+	c.Assert(rule.subscriptions("local"), DeepEquals, []string{"$cloud/device/+/channel/+/reply"})
+
+	compressed, _ := compressPayload(compressDeflate, s.payload)
+	msg := &bridgeMessage{topic: "$cloud/device/a/channel/b/reply/$deflate", payload: compressed}
+
+	c.Assert(s.bridge.decode(rule, "cloud", msg), IsNil)
+	c.Assert(msg.topic, Equals, "$cloud/device/a/channel/b/reply")
+	c.Assert(msg.payload, DeepEquals, s.payload)
+
+	msg = &bridgeMessage{topic: "$cloud/device/a/channel/b/reply/$deflate", payload: []byte("garbage")}
+	c.Assert(s.bridge.decode(rule, "cloud", msg), NotNil)
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+var ErrNoAnswer = errors.New("No answer from the agent")
+
+// exit codes of the commands which talk to a running agent
+const (
+	exitOk      = 0
+	exitFailed  = 1
+	exitTimeout = 2
+)
+
+// ControlCommand sends a connect or disconnect request to the running agent over
+// the local broker and waits for its response.
+type ControlCommand struct {
+	Ui     cli.Ui
+	Action string
+}
+
+func (c *ControlCommand) Run(args []string) int {
+
+	var localUrl, url, token, secretFile string
+	var timeout int
+
+	cmdFlags := flag.NewFlagSet(c.Action, flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&localUrl, "localurl", "tcp://localhost:1883", "URL for the local broker")
+	cmdFlags.StringVar(&secretFile, "control-secret-file", "", "file holding the secret to sign the request with")
+	cmdFlags.IntVar(&timeout, "timeout", 10, "seconds to wait for the agent")
+	if c.Action == "connect" {
+		cmdFlags.StringVar(&url, "url", "", "cloud url to connect to")
+		cmdFlags.StringVar(&token, "token", "", "token to connect with")
+	}
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return exitFailed
+	}
+
+	logRedactor.addSecret(token)
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	var topic string
+	var req controlRequest
+
+	switch c.Action {
+	case "connect":
+		if url == "" || token == "" {
+			c.Ui.Error("connect needs both -url and -token")
+			return exitFailed
+		}
+		topic, req = connectTopic, &connectRequest{Id: id, Url: url, Token: token}
+	case "disconnect":
+		topic, req = disconnectTopic, &disconnectRequest{Id: id}
+	default:
+		c.Ui.Error(fmt.Sprintf("unknown action %s", c.Action))
+		return exitFailed
+	}
+
+	if secretFile != "" {
+		secret, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to read control secret %s", err))
+			return exitFailed
+		}
+		signControlRequest(req, []byte(strings.TrimSpace(string(secret))), topic, time.Now())
+	}
+
+	payload, _ := json.Marshal(req)
+
+	reply, err := busRequest(localUrl, topic, responseTopic, id, payload, time.Duration(timeout)*time.Second)
+
+	if err == ErrNoAnswer {
+		c.Ui.Error(fmt.Sprintf("No answer from the agent within %ds, is it running?", timeout))
+		return exitTimeout
+	}
+
+	if err == ErrConnectTimeout {
+		c.Ui.Error(fmt.Sprintf("The broker at %s didn't accept the connection within %ds", logRedactor.redact(localUrl), timeout))
+		return exitTimeout
+	}
+
+	if err != nil {
+		c.Ui.Error(logRedactor.redactError(err))
+		return exitFailed
+	}
+
+	result := &resultStatus{}
+	json.Unmarshal(reply, result)
+
+	if result.LastError != "" {
+		c.Ui.Error(fmt.Sprintf("%s failed: %s", c.Action, result.LastError))
+		return exitFailed
+	}
+
+	c.Ui.Output(fmt.Sprintf("%s ok, connected: %t configured: %t", c.Action, result.Connected, result.Configured))
+
+	return exitOk
+}
+
+// Fills in the timestamp and signature the agent checks when it has a control secret.
+func signControlRequest(req controlRequest, secret []byte, topic string, now time.Time) {
+
+	auth := requestAuth{Timestamp: now.Unix()}
+	auth.Signature = signRequest(secret, topic, req.requestId(), auth.Timestamp, req.signedFields()...)
+
+	switch r := req.(type) {
+	case *connectRequest:
+		r.requestAuth = auth
+	case *reconfigureRequest:
+		r.requestAuth = auth
+	case *disconnectRequest:
+		r.requestAuth = auth
+	case *keysRequest:
+		r.requestAuth = auth
+	case *logRequest:
+		r.requestAuth = auth
+	}
+}
+
+// Publishes a request on the local broker and returns the first reply carrying
+// the same id, or ErrNoAnswer once the timeout has passed. ErrConnectTimeout is
+// returned when the broker doesn't accept the connection within the timeout.
+func busRequest(localUrl string, topic string, replyTopic string, id string, payload []byte, timeout time.Duration) ([]byte, error) {
+
+	deadline := time.After(timeout)
+
+	// paho exits the process when a connection drops unless something handles it, an
+	// abandoned connect or a dropped connection end in a timeout here instead
+	client := newPahoClient(&clientOptions{
+		server:           localUrl,
+		clientId:         fmt.Sprintf("mqtt-bridgeify-cli-%d", os.Getpid()),
+		connectTimeout:   timeout,
+		onConnectionLost: func(mqttClient, error) {},
+	})
+
+	if err := client.connect(); err == ErrConnectTimeout {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s %s", localUrl, err)
+	}
+
+	defer client.disconnect()
+
+	replies := make(chan []byte, 10)
+
+	err := client.subscribe(replyTopic, func(_ mqttClient, msg *bridgeMessage) {
+		select {
+		case replies <- msg.payload:
+		default:
+		}
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to subscribe to %s %s", replyTopic, err)
+	}
+
+	if err := client.publish(topic, payload); err != nil {
+		return nil, fmt.Errorf("Unable to publish to %s %s", topic, err)
+	}
+
+	for {
+		select {
+		case reply := <-replies:
+			answer := &struct {
+				Id string `json:"id"`
+			}{}
+			if json.Unmarshal(reply, answer) == nil && answer.Id == id {
+				return reply, nil
+			}
+			// someone else's answer
+		case <-deadline:
+			return nil, ErrNoAnswer
+		}
+	}
+}
+
+func (c *ControlCommand) Help() string {
+	if c.Action == "connect" {
+		return `
+Usage: mqtt-bridgeify connect -url=ssl://dev.ninjasphere.co:8883 -token=XXXX [options]
+
+  Tells the running agent to connect to the cloud and waits for its answer.
+  Exits with 1 if the agent reports an error and 2 if it doesn't answer.
+
+Options:
+
+  -localurl=tcp://localhost:1883      URL for the local broker.
+  -control-secret-file=/path/to/file  Sign the request with this secret.
+  -timeout=10                         Seconds to wait for the agent to answer.
+`
+	}
+	return `
+Usage: mqtt-bridgeify disconnect [options]
+
+  Tells the running agent to disconnect from the cloud and waits for its answer.
+  Exits with 1 if the agent reports an error and 2 if it doesn't answer.
+
+Options:
+
+  -localurl=tcp://localhost:1883      URL for the local broker.
+  -control-secret-file=/path/to/file  Sign the request with this secret.
+  -timeout=10                         Seconds to wait for the agent to answer.
+`
+}
+
+func (c *ControlCommand) Synopsis() string {
+	if c.Action == "connect" {
+		return "Tells the running agent to connect to the cloud"
+	}
+	return "Tells the running agent to disconnect from the cloud"
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/mitchellh/cli"
+	. "launchpad.net/gocheck"
+)
+
+type LoadControlCommandSuite struct{}
+
+var _ = Suite(&LoadControlCommandSuite{})
+
+func (s *LoadControlCommandSuite) TestSignedRequestsAreAccepted(c *C) {
+
+	auth := createAuthorizer(&Config{ControlSecret: "s3cr3t"})
+
+	connect := &connectRequest{Id: "1", Url: "ssl://dev.ninjasphere.co:8883", Token: "abc"}
+	signControlRequest(connect, []byte("s3cr3t"), connectTopic, time.Now())
+	c.Assert(auth.authorize(connectTopic, connect), IsNil)
+
+	disconnect := &disconnectRequest{Id: "2"}
+	signControlRequest(disconnect, []byte("wrong"), disconnectTopic, time.Now())
+	c.Assert(auth.authorize(disconnectTopic, disconnect), Equals, ErrBadSignature)
+}
+
+func (s *LoadControlCommandSuite) TestUsage(c *C) {
+
+	out := &bytes.Buffer{}
+	command := &ControlCommand{Ui: &cli.BasicUi{Writer: out}, Action: "connect"}
+
+	// both the url and token are needed before anything is sent
+	c.Assert(command.Run([]string{"-url", "ssl://dev.ninjasphere.co:8883"}), Equals, exitFailed)
+	c.Assert(out.String(), Matches, "connect needs both -url and -token\n")
+}
+
+func (s *LoadControlCommandSuite) TestNoBroker(c *C) {
+
+	_, err := busRequest("tcp://127.0.0.1:1", disconnectTopic, responseTopic, "1", []byte(`{}`), time.Second)
+	c.Assert(err, ErrorMatches, "Unable to connect to .*")
+}
+
+func (s *LoadControlCommandSuite) TestSilentBroker(c *C) {
+
+	// accepts connections but never answers them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	out := &bytes.Buffer{}
+	command := &ControlCommand{Ui: &cli.BasicUi{Writer: out}, Action: "disconnect"}
+
+	started := time.Now()
+	c.Assert(command.Run([]string{"-localurl", "tcp://" + listener.Addr().String(), "-timeout", "1"}), Equals, exitTimeout)
+	c.Assert(time.Since(started) < 3*time.Second, Equals, true)
+	c.Assert(out.String(), Matches, "The broker at .* didn't accept the connection within 1s\n")
+}
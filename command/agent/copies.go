@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long the remaining copies of a message are waited for
+const copyWindow = time.Second
+
+//
+// A broker delivers a message once for every subscription it matches, so a topic
+// matching more than one of the filters we subscribed to arrives several times
+// back to back. The first copy is handled, the rest are counted off and dropped.
+// Filters in a share group aren't counted, the broker may hand their copy to
+// another bridge in the group.
+//
+type copies struct {
+	filters []string
+	pending map[string]*pendingCopies
+	lock    sync.Mutex
+}
+
+type pendingCopies struct {
+	left int
+	seen time.Time
+}
+
+func createCopies(filters []string) *copies {
+
+	c := &copies{pending: make(map[string]*pendingCopies)}
+
+	for _, filter := range filters {
+		if !strings.HasPrefix(filter, sharePrefix) {
+			c.filters = append(c.filters, filter)
+		}
+	}
+
+	return c
+}
+
+// Returns true when the message is a further copy of one already handled.
+func (c *copies) extra(msg *bridgeMessage, now time.Time) bool {
+
+	key := fmt.Sprintf("%s\x00%x", msg.topic, sha256.Sum256(msg.payload))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// forget copies which never turned up
+	for k, p := range c.pending {
+		if now.Sub(p.seen) >= copyWindow {
+			delete(c.pending, k)
+		}
+	}
+
+	if p, ok := c.pending[key]; ok {
+		if p.left--; p.left == 0 {
+			delete(c.pending, key)
+		}
+		return true
+	}
+
+	matches := 0
+	for _, filter := range c.filters {
+		if matchTopic(filter, msg.topic) {
+			matches++
+		}
+	}
+
+	if matches > 1 {
+		c.pending[key] = &pendingCopies{left: matches - 1, seen: now}
+	}
+
+	return false
+}
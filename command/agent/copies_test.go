@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadCopiesSuite struct {
+	now time.Time
+}
+
+var _ = Suite(&LoadCopiesSuite{})
+
+func (s *LoadCopiesSuite) SetUpTest(c *C) {
+	s.now = time.Unix(1412345678, 0)
+}
+
+func (s *LoadCopiesSuite) TestExtra(c *C) {
+
+	copies := createCopies([]string{"$device/+/+/rssi", "$device/+/channel/+", "$device/a/#"})
+
+	// matches all three, so two more copies follow the first
+	rssi := &bridgeMessage{topic: "$device/a/channel/rssi", payload: []byte(`{"rssi":1}`)}
+	c.Assert(copies.extra(rssi, s.now), Equals, false)
+	c.Assert(copies.extra(rssi, s.now), Equals, true)
+	c.Assert(copies.extra(rssi, s.now), Equals, true)
+
+	// every copy has arrived, so this is sent again
+	c.Assert(copies.extra(rssi, s.now), Equals, false)
+
+	// only one subscription matches
+	state := &bridgeMessage{topic: "$device/b/channel/state", payload: []byte(`{}`)}
+	c.Assert(copies.extra(state, s.now), Equals, false)
+	c.Assert(copies.extra(state, s.now), Equals, false)
+}
+
+func (s *LoadCopiesSuite) TestMissingCopies(c *C) {
+
+	copies := createCopies([]string{"$device/+/+/rssi", "$device/+/channel/+"})
+
+	rssi := &bridgeMessage{topic: "$device/a/channel/rssi", payload: []byte(`{"rssi":1}`)}
+	c.Assert(copies.extra(rssi, s.now), Equals, false)
+
+	// the other copy never came, so later messages aren't mistaken for it
+	c.Assert(copies.extra(rssi, s.now.Add(copyWindow)), Equals, false)
+	c.Assert(copies.pending, HasLen, 1)
+}
+
+func (s *LoadCopiesSuite) TestShares(c *C) {
+
+	// the shared copy may go to another bridge
+	copies := createCopies([]string{"$share/bridges/$cloud/device/#", "$cloud/device/+/channel/+"})
+
+	msg := &bridgeMessage{topic: "$cloud/device/a/channel/b", payload: []byte(`{}`)}
+	c.Assert(copies.extra(msg, s.now), Equals, false)
+	c.Assert(copies.pending, HasLen, 0)
+}
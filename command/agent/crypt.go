@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var ErrNoKey = errors.New("No encryption key")
+var ErrUnknownKey = errors.New("Unknown encryption key")
+var ErrNotEncrypted = errors.New("Payload is not encrypted")
+
+// On disk layout of a keys file, keys are base64 encoded 16 or 32 byte AES keys.
+type keysConfig struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// What an encrypted payload looks like on the wire, the topic it is published on
+// is authenticated along with the data.
+type encryptedEnvelope struct {
+	Alg   string `json:"$enc"`
+	KeyId string `json:"kid"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+//
+// Holds the keys shared with the cloud services. Payloads are always encrypted
+// with the current key while any key still in the ring can decrypt, so keys can be
+// rotated by adding the new one as current and removing the old one once the
+// other side has caught up.
+//
+type keyring struct {
+	keys    map[string][]byte
+	current string
+	lock    sync.RWMutex
+}
+
+func createKeyring() *keyring {
+	return &keyring{keys: make(map[string][]byte)}
+}
+
+func loadKeyring(path string) (*keyring, error) {
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	conf := &keysConfig{}
+
+	if err := json.NewDecoder(file).Decode(conf); err != nil {
+		return nil, fmt.Errorf("unable to parse keys %s: %s", path, err)
+	}
+
+	ring := createKeyring()
+
+	for id, encoded := range conf.Keys {
+		if err := ring.addEncoded(id, encoded, id == conf.Current); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Current != "" && ring.current != conf.Current {
+		return nil, fmt.Errorf("current key %s is not in %s", conf.Current, path)
+	}
+
+	return ring, nil
+}
+
+func (k *keyring) addEncoded(id string, encoded string, current bool) error {
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return fmt.Errorf("key %s is not base64: %s", id, err)
+	}
+
+	logRedactor.addSecret(encoded)
+
+	return k.add(id, key, current)
+}
+
+func (k *keyring) add(id string, key []byte, current bool) error {
+
+	if id == "" {
+		return errors.New("key needs an id")
+	}
+
+	if len(key) != 16 && len(key) != 32 {
+		return fmt.Errorf("key %s must be 16 or 32 bytes", id)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.keys[id] = key
+
+	if current {
+		k.current = id
+	}
+
+	return nil
+}
+
+// Makes a key already in the ring the one used for encryption.
+func (k *keyring) use(id string) error {
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+
+	k.current = id
+
+	return nil
+}
+
+func (k *keyring) remove(id string) {
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	delete(k.keys, id)
+
+	if k.current == id {
+		k.current = ""
+	}
+}
+
+func (k *keyring) aead(id string) (cipher.AEAD, string, error) {
+
+	key, ok := k.keys[id]
+
+	if !ok {
+		return nil, "", ErrUnknownKey
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	return gcm, fmt.Sprintf("A%dGCM", len(key)*8), err
+}
+
+func (k *keyring) encrypt(topic string, payload []byte) ([]byte, error) {
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if k.current == "" {
+		return nil, ErrNoKey
+	}
+
+	gcm, alg, err := k.aead(k.current)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&encryptedEnvelope{
+		Alg:   alg,
+		KeyId: k.current,
+		Nonce: nonce,
+		Data:  gcm.Seal(nil, nonce, payload, []byte(topic)),
+	})
+}
+
+func (k *keyring) decrypt(topic string, payload []byte) ([]byte, error) {
+
+	envelope := &encryptedEnvelope{}
+
+	if err := json.Unmarshal(payload, envelope); err != nil || envelope.Alg == "" {
+		return nil, ErrNotEncrypted
+	}
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	gcm, alg, err := k.aead(envelope.KeyId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if alg != envelope.Alg || len(envelope.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("unexpected %s envelope for key %s", envelope.Alg, envelope.KeyId)
+	}
+
+	return gcm.Open(nil, envelope.Nonce, envelope.Data, []byte(topic))
+}
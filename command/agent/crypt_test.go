@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadCryptSuite struct {
+	payload []byte
+	bridge  *Bridge
+}
+
+var _ = Suite(&LoadCryptSuite{})
+
+func (s *LoadCryptSuite) SetUpTest(c *C) {
+	s.payload = []byte(`{"params":[{"position":{"x":1,"y":2}}],"jsonrpc":"2.0"}`)
+	s.bridge = createBridge(&Config{})
+	c.Assert(s.bridge.keys.add("k1", bytes.Repeat([]byte{1}, 32), true), IsNil)
+}
+
+func (s *LoadCryptSuite) TestRoundTrip(c *C) {
+	encrypted, err := s.bridge.keys.encrypt("$cloud/device/a/location", s.payload)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(encrypted, []byte("position")), Equals, false)
+
+	envelope := &encryptedEnvelope{}
+	c.Assert(json.Unmarshal(encrypted, envelope), IsNil)
+	c.Assert(envelope.Alg, Equals, "A256GCM")
+	c.Assert(envelope.KeyId, Equals, "k1")
+
+	data, err := s.bridge.keys.decrypt("$cloud/device/a/location", encrypted)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, s.payload)
+
+	// the topic is authenticated so a payload can't be replayed elsewhere
+	_, err = s.bridge.keys.decrypt("$cloud/device/b/location", encrypted)
+	c.Assert(err, NotNil)
+
+	envelope.Data[0] ^= 1
+	tampered, _ := json.Marshal(envelope)
+	_, err = s.bridge.keys.decrypt("$cloud/device/a/location", tampered)
+	c.Assert(err, NotNil)
+
+	_, err = s.bridge.keys.decrypt("$cloud/device/a/location", s.payload)
+	c.Assert(err, Equals, ErrNotEncrypted)
+}
+
+func (s *LoadCryptSuite) TestRotation(c *C) {
+	old, _ := s.bridge.keys.encrypt("topic", s.payload)
+
+	c.Assert(s.bridge.keys.add("k2", bytes.Repeat([]byte{2}, 16), true), IsNil)
+	current, _ := s.bridge.keys.encrypt("topic", s.payload)
+
+	envelope := &encryptedEnvelope{}
+	c.Assert(json.Unmarshal(current, envelope), IsNil)
+	c.Assert(envelope.KeyId, Equals, "k2")
+	c.Assert(envelope.Alg, Equals, "A128GCM")
+
+	// until it is removed the old key still decrypts
+	_, err := s.bridge.keys.decrypt("topic", old)
+	c.Assert(err, IsNil)
+
+	s.bridge.keys.remove("k1")
+	_, err = s.bridge.keys.decrypt("topic", old)
+	c.Assert(err, Equals, ErrUnknownKey)
+
+	c.Assert(s.bridge.keys.use("k1"), Equals, ErrUnknownKey)
+
+	s.bridge.keys.remove("k2")
+	_, err = s.bridge.keys.encrypt("topic", s.payload)
+	c.Assert(err, Equals, ErrNoKey)
+
+	c.Assert(s.bridge.keys.add("k3", []byte("short"), true), NotNil)
+}
+
+func (s *LoadCryptSuite) TestEncodeDecode(c *C) {
+
+	rule := replaceTopic{on: "$location/+", replace: "$location", with: "$cloud/location", encrypt: true}
+
+	topic, payload, err := s.bridge.encode(rule, "$cloud/location/a", s.payload)
+	c.Assert(err, IsNil)
+	c.Assert(topic, Equals, "$cloud/location/a")
+
+	msg := &bridgeMessage{topic: topic, payload: payload}
+	c.Assert(s.bridge.decode(rule, "cloud", msg), IsNil)
+	c.Assert(msg.payload, DeepEquals, s.payload)
+
+	// plaintext is never accepted on an encrypted rule
+	msg = &bridgeMessage{topic: topic, payload: s.payload}
+	c.Assert(s.bridge.decode(rule, "cloud", msg), Equals, ErrNotEncrypted)
+	c.Assert(atomic.LoadInt64(&s.bridge.DecryptFailures), Equals, int64(1))
+
+	s.bridge.keys.remove("k1")
+	_, _, err = s.bridge.encode(rule, "$cloud/location/a", s.payload)
+	c.Assert(err, Equals, ErrNoKey)
+	c.Assert(atomic.LoadInt64(&s.bridge.EncryptFailures), Equals, int64(1))
+}
+
+func (s *LoadCryptSuite) TestLoadKeyring(c *C) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+
+	path := filepath.Join(c.MkDir(), "keys.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{"current":"b","keys":{"a":"`+key+`","b":"`+key+`"}}`), 0600), IsNil)
+
+	ring, err := loadKeyring(path)
+	c.Assert(err, IsNil)
+	c.Assert(ring.current, Equals, "b")
+	c.Assert(ring.keys, HasLen, 2)
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"current":"c","keys":{"a":"`+key+`"}}`), 0600), IsNil)
+	_, err = loadKeyring(path)
+	c.Assert(err, ErrorMatches, "current key c is not in .*")
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"keys":{"a":"not base64!"}}`), 0600), IsNil)
+	_, err = loadKeyring(path)
+	c.Assert(err, ErrorMatches, "key a is not base64.*")
+}
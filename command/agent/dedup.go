@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultDedupSize = 1024
+
+//
+// Suppresses messages already forwarded within the last Window ms. Messages are
+// keyed on their topic and a hash of the payload, or when Field is set on the topic
+// and the value of that field in the JSON payload so redeliveries with a changed
+// timestamp are still caught. At most Size keys are remembered, the oldest are
+// forgotten first.
+//
+type deduper struct {
+	Window int    `json:"window"`
+	Size   int    `json:"size,omitempty"`
+	Field  string `json:"field,omitempty"`
+
+	seen  map[string]*list.Element
+	order *list.List
+	lock  sync.Mutex
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func (d *deduper) compile() error {
+
+	if d.Window <= 0 {
+		return fmt.Errorf("dedup window must be greater than zero")
+	}
+
+	if d.Size <= 0 {
+		d.Size = defaultDedupSize
+	}
+
+	d.seen = make(map[string]*list.Element)
+	d.order = list.New()
+
+	return nil
+}
+
+// Returns true when the message was already seen within the window, otherwise it
+// is remembered.
+func (d *deduper) duplicate(msg *bridgeMessage, now time.Time) bool {
+
+	key := d.key(msg)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	window := time.Duration(d.Window) * time.Millisecond
+
+	// forget everything which has fallen out of the window
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		entry := e.Value.(*dedupEntry)
+		if now.Sub(entry.seen) < window {
+			break
+		}
+		d.order.Remove(e)
+		delete(d.seen, entry.key)
+	}
+
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+
+	d.seen[key] = d.order.PushBack(&dedupEntry{key: key, seen: now})
+
+	if d.order.Len() > d.Size {
+		oldest := d.order.Front()
+		d.order.Remove(oldest)
+		delete(d.seen, oldest.Value.(*dedupEntry).key)
+	}
+
+	return false
+}
+
+func (d *deduper) key(msg *bridgeMessage) string {
+
+	if d.Field != "" {
+		var doc interface{}
+		if json.Unmarshal(msg.payload, &doc) == nil {
+			if value, ok := lookupField(doc, d.Field); ok {
+				return fmt.Sprintf("%s\x00id\x00%v", msg.topic, value)
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s\x00%x", msg.topic, sha256.Sum256(msg.payload))
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadDedupSuite struct {
+	now time.Time
+}
+
+var _ = Suite(&LoadDedupSuite{})
+
+func (s *LoadDedupSuite) SetUpTest(c *C) {
+	s.now = time.Unix(1412345678, 0)
+}
+
+func (s *LoadDedupSuite) TestWindow(c *C) {
+
+	dedup := &deduper{Window: 1000}
+	c.Assert(dedup.compile(), IsNil)
+
+	c.Assert(dedup.duplicate(message([]byte(`{"state":1}`)), s.now), Equals, false)
+	c.Assert(dedup.duplicate(message([]byte(`{"state":1}`)), s.now.Add(500*time.Millisecond)), Equals, true)
+	c.Assert(dedup.duplicate(message([]byte(`{"state":2}`)), s.now.Add(500*time.Millisecond)), Equals, false)
+
+	// the same payload on another topic is a different message
+	other := &bridgeMessage{topic: "u", payload: []byte(`{"state":1}`)}
+	c.Assert(dedup.duplicate(other, s.now.Add(500*time.Millisecond)), Equals, false)
+
+	c.Assert(dedup.duplicate(message([]byte(`{"state":1}`)), s.now.Add(1000*time.Millisecond)), Equals, false)
+}
+
+func (s *LoadDedupSuite) TestField(c *C) {
+
+	dedup := &deduper{Window: 1000, Field: "id"}
+	c.Assert(dedup.compile(), IsNil)
+
+	c.Assert(dedup.duplicate(message([]byte(`{"id":"a","time":1}`)), s.now), Equals, false)
+	c.Assert(dedup.duplicate(message([]byte(`{"id":"a","time":2}`)), s.now), Equals, true)
+	c.Assert(dedup.duplicate(message([]byte(`{"id":"b","time":2}`)), s.now), Equals, false)
+
+	// without the field the payload hash is used
+	c.Assert(dedup.duplicate(message([]byte(`{"time":3}`)), s.now), Equals, false)
+	c.Assert(dedup.duplicate(message([]byte(`{"time":3}`)), s.now), Equals, true)
+}
+
+func (s *LoadDedupSuite) TestSize(c *C) {
+
+	dedup := &deduper{Window: 1000, Size: 2}
+	c.Assert(dedup.compile(), IsNil)
+
+	c.Assert(dedup.duplicate(message([]byte("1")), s.now), Equals, false)
+	c.Assert(dedup.duplicate(message([]byte("2")), s.now), Equals, false)
+	c.Assert(dedup.duplicate(message([]byte("3")), s.now), Equals, false)
+	c.Assert(dedup.order.Len(), Equals, 2)
+
+	// the oldest key was forgotten to stay within the bound
+	c.Assert(dedup.duplicate(message([]byte("1")), s.now), Equals, false)
+	c.Assert(dedup.duplicate(message([]byte("3")), s.now), Equals, true)
+
+	c.Assert((&deduper{}).compile(), NotNil)
+}
+
+func (s *LoadDedupSuite) TestRules(c *C) {
+
+	conf := &rulesConfig{Dedup: &dedupConfig{Cloud: &deduper{Window: 5000}}}
+	rules, err := conf.compile("")
+	c.Assert(err, IsNil)
+	c.Assert(rules.localDedup, IsNil)
+	c.Assert(rules.cloudDedup.Size, Equals, defaultDedupSize)
+
+	bridge := createBridge(&Config{rules: rules})
+	c.Assert(bridge.dedup("cloud"), Equals, rules.cloudDedup)
+	c.Assert(bridge.dedup("local"), IsNil)
+
+	conf = &rulesConfig{Dedup: &dedupConfig{Local: &deduper{}}}
+	_, err = conf.compile("")
+	c.Assert(err, ErrorMatches, `\(local\) dedup window .*`)
+}
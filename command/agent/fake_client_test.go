@@ -0,0 +1,296 @@
+package agent
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var errFakeUnknownServer = errors.New("no fake broker at that address")
+
+//
+// An in-memory broker for fake clients. Messages are delivered synchronously on
+// the publisher's goroutine, so once publish returns everything it caused has
+// happened. Faults can be switched on and off at any time to see how the bridge
+// copes with a broker that refuses connections, fails subscriptions, loses
+// messages or drops every client.
+//
+type fakeBroker struct {
+	clients   map[*fakeClient]bool
+	published []brokerMessage
+	connects  []clientOptions
+
+	// faults, nil or false when the broker behaves
+	connectErr   error
+	subscribeErr error
+	publishErr   error
+	lose         bool
+
+	lock sync.Mutex
+}
+
+type fakeClient struct {
+	broker    *fakeBroker
+	opts      *clientOptions
+	connected bool
+	handlers  map[string]messageHandler
+	lock      sync.Mutex
+}
+
+func createFakeBroker() *fakeBroker {
+	return &fakeBroker{clients: make(map[*fakeClient]bool)}
+}
+
+// Hands out clients for whichever fake broker is registered under the server url.
+func fakeClients(brokers map[string]*fakeBroker) clientFactory {
+	return func(opts *clientOptions) mqttClient {
+		if broker, ok := brokers[opts.server]; ok {
+			return broker.newClient(opts)
+		}
+		return &fakeClient{opts: opts, handlers: make(map[string]messageHandler)}
+	}
+}
+
+func (b *fakeBroker) newClient(opts *clientOptions) mqttClient {
+	return &fakeClient{broker: b, opts: opts, handlers: make(map[string]messageHandler)}
+}
+
+// Makes connects fail with err, nil lets them through again.
+func (b *fakeBroker) refuse(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.connectErr = err
+}
+
+func (b *fakeBroker) failSubscribes(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribeErr = err
+}
+
+func (b *fakeBroker) failPublishes(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.publishErr = err
+}
+
+// Accepts publishes without recording or delivering them.
+func (b *fakeBroker) loseMessages(lose bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lose = lose
+}
+
+// Disconnects every client and tells it the connection was lost.
+func (b *fakeBroker) drop(reason error) {
+	for _, client := range b.connected() {
+		client.lock.Lock()
+		client.connected = false
+		client.lock.Unlock()
+
+		b.lock.Lock()
+		delete(b.clients, client)
+		b.lock.Unlock()
+
+		if client.opts.onConnectionLost != nil {
+			client.opts.onConnectionLost(client, reason)
+		}
+	}
+}
+
+// Delivers a message to subscribers as if another client had published it.
+func (b *fakeBroker) publish(topic string, payload []byte) {
+	b.route(&brokerMessage{clientId: "test", topic: topic, payload: payload})
+}
+
+func (b *fakeBroker) publishedOn(filter string) []brokerMessage {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	msgs := []brokerMessage{}
+	for _, published := range b.published {
+		if matchTopic(filter, published.topic) {
+			msgs = append(msgs, published)
+		}
+	}
+	return msgs
+}
+
+// Whether a connected client is subscribed to exactly this filter.
+func (b *fakeBroker) subscribed(filter string) bool {
+	for _, client := range b.connected() {
+		client.lock.Lock()
+		_, ok := client.handlers[filter]
+		client.lock.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fakeBroker) lastConnect() clientOptions {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.connects) == 0 {
+		return clientOptions{}
+	}
+	return b.connects[len(b.connects)-1]
+}
+
+func (b *fakeBroker) connected() []*fakeClient {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	clients := []*fakeClient{}
+	for client := range b.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func (b *fakeBroker) route(msg *brokerMessage) {
+
+	b.lock.Lock()
+	if b.lose {
+		b.lock.Unlock()
+		return
+	}
+	b.published = append(b.published, *msg)
+	b.lock.Unlock()
+
+	for _, client := range b.connected() {
+		client.deliver(msg)
+	}
+}
+
+func (c *fakeClient) connect() error {
+
+	if c.broker == nil {
+		return errFakeUnknownServer
+	}
+
+	c.broker.lock.Lock()
+	defer c.broker.lock.Unlock()
+
+	c.broker.connects = append(c.broker.connects, *c.opts)
+
+	if c.broker.connectErr != nil {
+		return c.broker.connectErr
+	}
+
+	c.lock.Lock()
+	c.connected = true
+	c.lock.Unlock()
+
+	c.broker.clients[c] = true
+
+	return nil
+}
+
+func (c *fakeClient) subscribe(filter string, handler messageHandler) error {
+
+	if !c.isConnected() {
+		return ErrNotConnected
+	}
+
+	c.broker.lock.Lock()
+	err := c.broker.subscribeErr
+	c.broker.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.handlers[filter] = handler
+	c.lock.Unlock()
+
+	return nil
+}
+
+func (c *fakeClient) unsubscribe(filters ...string) error {
+
+	if !c.isConnected() {
+		return ErrNotConnected
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, filter := range filters {
+		delete(c.handlers, filter)
+	}
+	return nil
+}
+
+func (c *fakeClient) publish(topic string, payload []byte) error {
+
+	if !c.isConnected() {
+		return ErrNotConnected
+	}
+
+	c.broker.lock.Lock()
+	err := c.broker.publishErr
+	c.broker.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	c.broker.route(&brokerMessage{clientId: c.opts.clientId, topic: topic, payload: payload})
+
+	return nil
+}
+
+func (c *fakeClient) isConnected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.connected
+}
+
+func (c *fakeClient) disconnect() {
+
+	c.lock.Lock()
+	c.connected = false
+	c.lock.Unlock()
+
+	if c.broker != nil {
+		c.broker.lock.Lock()
+		delete(c.broker.clients, c)
+		c.broker.lock.Unlock()
+	}
+}
+
+// Calls the handler of every matching subscription, subscriptions without one share
+// a single call of the default handler, the same as the paho client.
+func (c *fakeClient) deliver(msg *brokerMessage) {
+
+	c.lock.Lock()
+	handlers := []messageHandler{}
+	useDefault := false
+	for filter, handler := range c.handlers {
+		if strings.HasPrefix(filter, sharePrefix) {
+			// $share/<group>/<filter>
+			filter = strings.SplitN(filter, "/", 3)[2]
+		}
+		if !matchTopic(filter, msg.topic) {
+			continue
+		}
+		if handler != nil {
+			handlers = append(handlers, handler)
+		} else {
+			useDefault = true
+		}
+	}
+	c.lock.Unlock()
+
+	if useDefault && c.opts.onMessage != nil {
+		handlers = append(handlers, c.opts.onMessage)
+	}
+
+	for _, handler := range handlers {
+		handler(c, &bridgeMessage{topic: msg.topic, payload: msg.payload, size: len(msg.topic) + len(msg.payload)})
+	}
+}
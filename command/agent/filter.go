@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//
+// A predicate on one field of a JSON payload. The field is a dot separated path
+// where numeric elements index into arrays, eg. "params.0.rssi". Every condition
+// which is set must hold for the filter to pass.
+//
+type payloadFilter struct {
+	Field   string      `json:"field"`
+	Equals  interface{} `json:"equals,omitempty"`
+	Exists  *bool       `json:"exists,omitempty"`
+	Min     *float64    `json:"min,omitempty"`
+	Max     *float64    `json:"max,omitempty"`
+	Matches string      `json:"matches,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Checks the filter is usable and compiles its regex.
+func (f *payloadFilter) compile() (err error) {
+
+	if f.Field == "" {
+		return errors.New("filter is missing a field")
+	}
+
+	if f.Equals == nil && f.Exists == nil && f.Min == nil && f.Max == nil && f.Matches == "" {
+		return fmt.Errorf("filter on %s has no condition", f.Field)
+	}
+
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		return fmt.Errorf("filter on %s has min greater than max", f.Field)
+	}
+
+	if f.Matches != "" {
+		if f.pattern, err = regexp.Compile(f.Matches); err != nil {
+			return fmt.Errorf("filter on %s has a bad regex %s", f.Field, err)
+		}
+	}
+
+	return nil
+}
+
+func (f *payloadFilter) matches(doc interface{}) bool {
+
+	value, found := lookupField(doc, f.Field)
+
+	if f.Exists != nil && *f.Exists != found {
+		return false
+	}
+
+	if !found {
+		// only an exists:false filter can pass on a missing field
+		return f.Exists != nil
+	}
+
+	if f.Equals != nil && !reflect.DeepEqual(value, f.Equals) {
+		return false
+	}
+
+	if f.Min != nil || f.Max != nil {
+		number, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		if f.Min != nil && number < *f.Min {
+			return false
+		}
+		if f.Max != nil && number > *f.Max {
+			return false
+		}
+	}
+
+	if f.pattern != nil {
+		switch v := value.(type) {
+		case string:
+			return f.pattern.MatchString(v)
+		case float64:
+			return f.pattern.MatchString(strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			return f.pattern.MatchString(strconv.FormatBool(v))
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Walks a decoded JSON document along a dot separated path.
+func lookupField(doc interface{}, path string) (interface{}, bool) {
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
+
+// Returns true if the payload passes all the filters, payloads which aren't JSON
+// never pass a non empty filter list.
+func acceptPayload(filters []*payloadFilter, payload []byte) bool {
+
+	if len(filters) == 0 {
+		return true
+	}
+
+	var doc interface{}
+
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return false
+	}
+
+	for _, f := range filters {
+		if !f.matches(doc) {
+			return false
+		}
+	}
+
+	return true
+}
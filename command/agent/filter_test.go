@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"encoding/json"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadFilterSuite struct {
+	payload []byte
+}
+
+var _ = Suite(&LoadFilterSuite{})
+
+func (s *LoadFilterSuite) SetUpTest(c *C) {
+	s.payload = []byte(`{"id":"abc","params":[{"rssi":-72,"name":"tag-1"}],"jsonrpc":"2.0","online":true}`)
+}
+
+func filters(c *C, spec string) []*payloadFilter {
+	list := []*payloadFilter{}
+	c.Assert(json.Unmarshal([]byte(spec), &list), IsNil)
+	for _, f := range list {
+		c.Assert(f.compile(), IsNil)
+	}
+	return list
+}
+
+func (s *LoadFilterSuite) TestEquals(c *C) {
+	c.Assert(acceptPayload(filters(c, `[{"field":"jsonrpc","equals":"2.0"}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"online","equals":true}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"params.0.rssi","equals":-72}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"jsonrpc","equals":"1.0"}]`), s.payload), Equals, false)
+}
+
+func (s *LoadFilterSuite) TestExists(c *C) {
+	c.Assert(acceptPayload(filters(c, `[{"field":"params.0.name","exists":true}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"params.1.name","exists":true}]`), s.payload), Equals, false)
+	c.Assert(acceptPayload(filters(c, `[{"field":"error","exists":false}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"id","exists":false}]`), s.payload), Equals, false)
+}
+
+func (s *LoadFilterSuite) TestRange(c *C) {
+	c.Assert(acceptPayload(filters(c, `[{"field":"params.0.rssi","min":-80,"max":-60}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"params.0.rssi","min":-70}]`), s.payload), Equals, false)
+	c.Assert(acceptPayload(filters(c, `[{"field":"id","max":10}]`), s.payload), Equals, false)
+	c.Assert(acceptPayload(filters(c, `[{"field":"missing","min":0}]`), s.payload), Equals, false)
+}
+
+func (s *LoadFilterSuite) TestMatches(c *C) {
+	c.Assert(acceptPayload(filters(c, `[{"field":"params.0.name","matches":"^tag-[0-9]+$"}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"params.0.rssi","matches":"^-7"}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"id","matches":"^x"}]`), s.payload), Equals, false)
+}
+
+func (s *LoadFilterSuite) TestAllMustPass(c *C) {
+	c.Assert(acceptPayload(filters(c, `[{"field":"id","exists":true},{"field":"jsonrpc","equals":"2.0"}]`), s.payload), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"id","exists":true},{"field":"jsonrpc","equals":"1.0"}]`), s.payload), Equals, false)
+}
+
+func (s *LoadFilterSuite) TestNotJson(c *C) {
+	c.Assert(acceptPayload(nil, []byte("plain text")), Equals, true)
+	c.Assert(acceptPayload(filters(c, `[{"field":"id","exists":false}]`), []byte("plain text")), Equals, false)
+}
+
+func (s *LoadFilterSuite) TestCompile(c *C) {
+	c.Assert((&payloadFilter{}).compile(), NotNil)
+	c.Assert((&payloadFilter{Field: "id"}).compile(), NotNil)
+	c.Assert((&payloadFilter{Field: "id", Matches: "("}).compile(), NotNil)
+
+	min, max := 10.0, 1.0
+	c.Assert((&payloadFilter{Field: "id", Min: &min, Max: &max}).compile(), NotNil)
+}
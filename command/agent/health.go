@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+//
+// Answers health checks from supervisors on a local HTTP address.
+//
+// /healthz is ok while the process serves requests, the bus is connected and
+// turning over and the bridge isn't hung, a failure here means the agent should be
+// restarted.
+//
+// /readyz is ok once the bridge is configured with both legs connected, and stays
+// ok through reconnects shorter than the ready threshold.
+//
+// Both answer 200 or 503 with the status the agent publishes on the bus.
+//
+type healthServer struct {
+	agent          *Agent
+	bus            *Bus
+	readyThreshold time.Duration
+	listener       net.Listener
+	log            loggo.Logger
+}
+
+type healthReport struct {
+	Ok       bool     `json:"ok"`
+	Problems []string `json:"problems"`
+	statsEvent
+
+	LocalConnected bool `json:"localConnected"`
+	CloudConnected bool `json:"cloudConnected"`
+}
+
+func createHealthServer(conf *Config, agent *Agent, bus *Bus) *healthServer {
+	return &healthServer{
+		agent:          agent,
+		bus:            bus,
+		readyThreshold: time.Duration(conf.ReadyThreshold) * time.Second,
+		log:            loggo.GetLogger("health"),
+	}
+}
+
+// Starts serving on addr in the background.
+func (h *healthServer) start(addr string) error {
+
+	listener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	h.listener = listener
+
+	h.log.Infof("health checks on http://%s/healthz and /readyz", listener.Addr())
+
+	go http.Serve(listener, h.handler())
+
+	return nil
+}
+
+func (h *healthServer) stop() {
+	if h.listener != nil {
+		h.listener.Close()
+	}
+}
+
+func (h *healthServer) handler() http.Handler {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, h.health(time.Now()))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, h.readiness(time.Now()))
+	})
+
+	return mux
+}
+
+func (h *healthServer) health(now time.Time) *healthReport {
+
+	report := h.report()
+	report.Problems = liveness(h.agent, h.bus, now)
+	report.Ok = len(report.Problems) == 0
+
+	return report
+}
+
+// What stops the agent doing its job, empty while the bus is alive and the bridge
+// isn't hung handling a lost connection.
+func liveness(agent *Agent, bus *Bus, now time.Time) []string {
+
+	problems := []string{}
+
+	if alive, problem := bus.alive(now); !alive {
+		problems = append(problems, problem)
+	}
+
+	if agent.bridge.hung(now) {
+		problems = append(problems, "bridge is hung handling a lost connection")
+	}
+
+	return problems
+}
+
+func (h *healthServer) readiness(now time.Time) *healthReport {
+
+	report := h.report()
+	bridge := h.agent.bridge
+
+	switch {
+	case !report.Configured:
+		report.Problems = append(report.Problems, "bridge is not configured")
+	case report.CredentialsRequired:
+		report.Problems = append(report.Problems, "cloud rejected the token")
+	case !report.LocalConnected || !report.CloudConnected:
+		down := bridge.downFor(now)
+		if down == 0 || down > h.readyThreshold {
+			report.Problems = append(report.Problems, fmt.Sprintf("bridge disconnected, local: %t cloud: %t", report.LocalConnected, report.CloudConnected))
+		}
+	}
+
+	report.Ok = len(report.Problems) == 0
+
+	return report
+}
+
+func (h *healthServer) report() *healthReport {
+
+	local, cloud := h.agent.bridge.legsConnected()
+
+	return &healthReport{
+		Problems:       []string{},
+		statsEvent:     h.agent.getStatus(),
+		LocalConnected: local,
+		CloudConnected: cloud,
+	}
+}
+
+func (h *healthServer) respond(w http.ResponseWriter, report *healthReport) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if report.Ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
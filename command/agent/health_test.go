@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadHealthSuite struct {
+	local  *fakeBroker
+	cloud  *fakeBroker
+	agent  *Agent
+	bus    *Bus
+	health *healthServer
+}
+
+var _ = Suite(&LoadHealthSuite{})
+
+func (s *LoadHealthSuite) SetUpTest(c *C) {
+	s.local = createFakeBroker()
+	s.cloud = createFakeBroker()
+
+	conf := &Config{LocalUrl: fakeLocalUrl, SerialNo: "1234", ReadyThreshold: 30}
+	clients := fakeClients(map[string]*fakeBroker{fakeLocalUrl: s.local, fakeCloudUrl: s.cloud})
+
+	s.agent = createAgent(conf)
+	s.agent.bridge.newClient = clients
+	s.agent.bridge.reconnectDelay = time.Hour
+
+	s.bus = createBus(conf, s.agent)
+	s.bus.client = clients(&clientOptions{server: fakeLocalUrl})
+	c.Assert(s.bus.client.connect(), IsNil)
+	s.bus.touch()
+
+	s.health = createHealthServer(conf, s.agent, s.bus)
+}
+
+func (s *LoadHealthSuite) TearDownTest(c *C) {
+	if s.agent.bridge.flags().Configured {
+		s.agent.bridge.stop()
+	}
+}
+
+func (s *LoadHealthSuite) get(c *C, path string) (int, *healthReport) {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	s.health.handler().ServeHTTP(recorder, req)
+
+	c.Assert(recorder.Header().Get("Content-Type"), Equals, "application/json")
+
+	report := &healthReport{}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), report), IsNil)
+	return recorder.Code, report
+}
+
+func (s *LoadHealthSuite) TestHealthz(c *C) {
+
+	code, report := s.get(c, "/healthz")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(report.Ok, Equals, true)
+	c.Assert(report.Problems, HasLen, 0)
+
+	// healthy even though the bridge isn't
+	c.Assert(report.Configured, Equals, false)
+
+	// a background job that stopped turning over
+	c.Assert(s.health.health(time.Now().Add(time.Minute)).Problems, DeepEquals, []string{"bus has been stuck for 1m0s"})
+
+	s.bus.client.disconnect()
+
+	code, report = s.get(c, "/healthz")
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	c.Assert(report.Ok, Equals, false)
+	c.Assert(report.Problems, DeepEquals, []string{"bus is not connected"})
+}
+
+func (s *LoadHealthSuite) TestReadyz(c *C) {
+
+	code, report := s.get(c, "/readyz")
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	c.Assert(report.Problems, DeepEquals, []string{"bridge is not configured"})
+
+	c.Assert(s.agent.bridge.start(fakeCloudUrl, "health-token"), IsNil)
+
+	code, report = s.get(c, "/readyz")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(report.Connected, Equals, true)
+	c.Assert(report.LocalConnected, Equals, true)
+	c.Assert(report.CloudConnected, Equals, true)
+
+	// a short outage is tolerated, a long one isn't
+	s.cloud.refuse(ErrNotConnected)
+	s.cloud.drop(errors.New("EOF"))
+
+	now := time.Now()
+	c.Assert(s.health.readiness(now).Ok, Equals, true)
+	c.Assert(s.health.readiness(now.Add(31*time.Second)).Problems, DeepEquals, []string{"bridge disconnected, local: false cloud: false"})
+
+	// the bridge going down doesn't make the agent unhealthy
+	c.Assert(s.health.health(now).Ok, Equals, true)
+
+	s.agent.bridge.CredentialsRequired = true
+	c.Assert(s.health.readiness(now).Problems, DeepEquals, []string{"cloud rejected the token"})
+}
+
+func (s *LoadHealthSuite) TestServe(c *C) {
+
+	c.Assert(s.health.start("127.0.0.1:0"), IsNil)
+	defer s.health.stop()
+
+	resp, err := http.Get("http://" + s.health.listener.Addr().String() + "/healthz")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+}
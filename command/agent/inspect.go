@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What the bridge would do with a message, worked out without a broker.
+type ruleTrace struct {
+	Index    int
+	Rule     replaceTopic
+	Matched  bool
+	Topic    string
+	Payload  []byte
+	Filtered bool
+	Tagged   bool
+	Loop     string
+}
+
+// Describes a rule on one line, for listing the effective rules.
+func (r *replaceTopic) describe() string {
+
+	parts := []string{r.on}
+
+	switch {
+	case r.unbatch:
+		parts = append(parts, "=> unbatch")
+	case r.rewrite != nil && r.rewrite.regex != nil:
+		parts = append(parts, fmt.Sprintf("=> match %q to %s", r.rewrite.regex.String(), r.rewrite.to))
+	case r.rewrite != nil:
+		parts = append(parts, "=> "+r.rewrite.to)
+	default:
+		parts = append(parts, fmt.Sprintf("=> replace %s with %s", r.replace, r.with))
+	}
+
+	if r.priority != 0 {
+		parts = append(parts, fmt.Sprintf("priority=%d", r.priority))
+	}
+	if len(r.filters) > 0 {
+		parts = append(parts, fmt.Sprintf("filters=%d", len(r.filters)))
+	}
+	if r.limiter != nil {
+		parts = append(parts, fmt.Sprintf("rateLimit=%g/s", r.limiter.Rate))
+	}
+	if r.sampler != nil {
+		parts = append(parts, "sample="+r.sampler.Mode)
+	}
+	if r.compress != "" {
+		parts = append(parts, "compress="+r.compress)
+	}
+	if r.batch != nil {
+		parts = append(parts, "batch="+r.batch.Topic)
+	}
+	if r.encrypt {
+		parts = append(parts, "encrypt")
+	}
+	if r.share != "" {
+		parts = append(parts, "share="+r.share)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Runs a message through the rules for a direction the way the bridge would,
+// stopping short of rate limits and sampling which depend on earlier messages.
+func (b *Bridge) trace(tag string, topic string, payload []byte) *ruleTrace {
+
+	result := &ruleTrace{Index: -1}
+
+	for i, rule := range b.rules(tag) {
+		for _, filter := range rule.subscriptions(tag) {
+			if !result.Matched && matchTopic(filter, topic) {
+				result.Index = i
+				result.Rule = rule
+				result.Matched = true
+			}
+		}
+	}
+
+	if !result.Matched || result.Rule.unbatch {
+		return result
+	}
+
+	if result.Filtered = !acceptPayload(result.Rule.filters, payload); result.Filtered {
+		return result
+	}
+
+	if result.Topic = result.Rule.updated(topic); result.Topic == "" {
+		return result
+	}
+
+	result.Tagged = !strings.Contains(string(payload), "$mesh-source")
+	result.Payload, _ = b.updateSource(payload, b.traceSource(tag))
+
+	// would the other direction pick the message straight back up
+	other := "cloud"
+	if tag == "cloud" {
+		other = "local"
+	}
+	for i, rule := range b.rules(other) {
+		if !rule.unbatch && matchTopic(rule.on, result.Topic) {
+			result.Loop = fmt.Sprintf("%s rule %d %s publishes it again on %s", other, i, rule.on, rule.updated(result.Topic))
+			break
+		}
+	}
+
+	return result
+}
+
+// The source the bridge tags messages with, the cloud host is only known once
+// the bridge has been configured.
+func (b *Bridge) traceSource(tag string) string {
+	if tag == "cloud" && b.cloudUrl == nil {
+		return "cloud"
+	}
+	return b.buildSource(tag)
+}
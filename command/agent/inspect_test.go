@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/mitchellh/cli"
+	. "launchpad.net/gocheck"
+)
+
+type LoadInspectSuite struct {
+	bridge *Bridge
+}
+
+var _ = Suite(&LoadInspectSuite{})
+
+func (s *LoadInspectSuite) SetUpTest(c *C) {
+	s.bridge = createBridge(&Config{SerialNo: "1234"})
+	s.bridge.newTraceId = fakeTraceIds()
+}
+
+func (s *LoadInspectSuite) TestTrace(c *C) {
+
+	result := s.bridge.trace("local", "$device/a/channel/b", []byte(`{"params":[1]}`))
+	c.Assert(result.Matched, Equals, true)
+	c.Assert(result.Rule.on, Equals, "$device/+/channel/+")
+	c.Assert(result.Topic, Equals, "$cloud/device/a/channel/b")
+	c.Assert(string(result.Payload), Equals, `{"$mesh-source":"1234", "$mesh-trace":"trace-1", "params":[1]}`)
+	c.Assert(result.Tagged, Equals, true)
+	c.Assert(result.Loop, Equals, "")
+
+	// a reply is sent to the cloud on the alternate topic the cloud rules don't bring back
+	result = s.bridge.trace("local", "$device/a/channel/b/reply", []byte(`{"$mesh-source":"x"}`))
+	c.Assert(result.Topic, Equals, "$cloud/remote_device/a/channel/b/reply")
+	c.Assert(result.Tagged, Equals, false)
+	c.Assert(result.Loop, Equals, "")
+
+	result = s.bridge.trace("cloud", "$cloud/remote_device/a/channel/b", []byte(`{}`))
+	c.Assert(result.Topic, Equals, "$device/a/channel/b")
+	c.Assert(result.Loop, Matches, "local rule .* publishes it again on \\$cloud/device/a/channel/b")
+
+	result = s.bridge.trace("local", "$nothing/here", nil)
+	c.Assert(result.Matched, Equals, false)
+}
+
+func (s *LoadInspectSuite) TestTraceFiltered(c *C) {
+
+	s.bridge.localTopics = []replaceTopic{
+		{on: "$device/+", replace: "$device", with: "$cloud/device", filters: []*payloadFilter{{Field: "level", Exists: new(bool)}}},
+	}
+	c.Assert(s.bridge.localTopics[0].filters[0].compile(), IsNil)
+
+	c.Assert(s.bridge.trace("local", "$device/a", []byte(`{"level":1}`)).Filtered, Equals, true)
+	c.Assert(s.bridge.trace("local", "$device/a", []byte(`{}`)).Filtered, Equals, false)
+}
+
+func (s *LoadInspectSuite) TestCommand(c *C) {
+
+	out := &bytes.Buffer{}
+	command := &RulesCommand{Ui: &cli.BasicUi{Writer: out}}
+
+	c.Assert(command.Run([]string{"-serial", "1234", "list"}), Equals, exitOk)
+	c.Assert(strings.Contains(out.String(), "$device/+/channel/+ => replace $device with $cloud/device"), Equals, true)
+
+	out.Reset()
+	c.Assert(command.Run([]string{"test", "local", "$location/calibration", `{"x":1}`}), Equals, exitOk)
+	c.Assert(strings.Contains(out.String(), "topic:   $cloud/location/calibration"), Equals, true)
+
+	out.Reset()
+	c.Assert(command.Run([]string{"test", "local", "$nothing/here"}), Equals, exitFailed)
+	c.Assert(command.Run([]string{"test", "sideways", "$nothing/here"}), Equals, exitFailed)
+}
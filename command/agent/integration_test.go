@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+// Runs the bridge between two in-process brokers.
+type LoadIntegrationSuite struct {
+	local  *testBroker
+	cloud  *testBroker
+	bridge *Bridge
+}
+
+var _ = Suite(&LoadIntegrationSuite{})
+
+func (s *LoadIntegrationSuite) SetUpTest(c *C) {
+	s.local = startBroker(c)
+	s.cloud = startBroker(c)
+
+	s.bridge = createBridge(&Config{LocalUrl: s.local.url(), SerialNo: "1234"})
+	s.bridge.reconnectDelay = 100 * time.Millisecond
+	s.bridge.eventCh = make(chan bridgeEvent, 10)
+}
+
+func (s *LoadIntegrationSuite) TearDownTest(c *C) {
+	if s.bridge.flags().Configured {
+		s.bridge.stop()
+	}
+	s.local.close()
+	s.cloud.close()
+}
+
+// Waits for both legs to be up and subscribed.
+func (s *LoadIntegrationSuite) waitBridged(c *C) {
+	c.Assert(s.local.waitSubscribed("$device/+/channel/+"), IsNil)
+	c.Assert(s.cloud.waitSubscribed("$cloud/device/+/channel/+/reply"), IsNil)
+	c.Assert(s.local.wait(s.bridge.IsConnected), IsNil)
+}
+
+func (s *LoadIntegrationSuite) TestForward(c *C) {
+
+	c.Assert(s.bridge.start(s.cloud.url(), "integration-token"), IsNil)
+	s.waitBridged(c)
+
+	c.Assert(s.cloud.lastConnect().username, Equals, "integration-token")
+
+	s.local.publish("$device/a/channel/b", []byte(`{"params":[1]}`))
+
+	msg, err := s.cloud.waitPublished("$cloud/device/a/channel/b")
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.payload), Matches, `\{"\$mesh-source":"1234", "\$mesh-trace":"[0-9a-f]{16}", "params":\[1\]\}`)
+
+	s.cloud.publish("$cloud/device/a/channel/b/reply", []byte(`{"result":true}`))
+
+	msg, err = s.local.waitPublished("$device/a/channel/b/reply")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(msg.payload), `{"$mesh-source":"cloud-127_0_0_1:`), Equals, true)
+
+	c.Assert(s.bridge.IngressCounter, Equals, int64(1))
+
+	// the local reply is also sent up on the remote device topic
+	msg, err = s.cloud.waitPublished("$cloud/remote_device/a/channel/b/reply")
+	c.Assert(err, IsNil)
+
+	// matches two rules, but is delivered by the broker and forwarded once
+	s.local.publish("$device/a/channel/rssi", []byte(`{}`))
+	_, err = s.cloud.waitPublished("$cloud/device/a/channel/rssi")
+	c.Assert(err, IsNil)
+
+	// topics no rule covers stay put
+	s.local.publish("$node/a/module/status", []byte(`{}`))
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(s.cloud.publishedOn("$cloud/node/#"), HasLen, 0)
+	c.Assert(s.cloud.publishedOn("$cloud/device/a/channel/rssi"), HasLen, 1)
+}
+
+func (s *LoadIntegrationSuite) TestDisconnect(c *C) {
+
+	c.Assert(s.bridge.start(s.cloud.url(), "integration-token"), IsNil)
+	s.waitBridged(c)
+
+	c.Assert(s.bridge.stop(), IsNil)
+
+	c.Assert(s.local.wait(func() bool { return s.local.clients() == 0 && s.cloud.clients() == 0 }), IsNil)
+	c.Assert(s.bridge.IsConnected(), Equals, false)
+	c.Assert(s.bridge.flags().Configured, Equals, false)
+}
+
+func (s *LoadIntegrationSuite) TestReconnect(c *C) {
+
+	c.Assert(s.bridge.start(s.cloud.url(), "integration-token"), IsNil)
+	s.waitBridged(c)
+
+	// the cloud goes away for a while
+	s.cloud.close()
+	c.Assert(s.local.wait(func() bool { return !s.bridge.IsConnected() }), IsNil)
+
+	time.Sleep(300 * time.Millisecond)
+	s.cloud.restart(c)
+
+	s.waitBridged(c)
+	c.Assert(s.bridge.flags().LastError, IsNil)
+
+	s.local.publish("$device/a/channel/b", []byte(`{}`))
+	_, err := s.cloud.waitPublished("$cloud/device/a/channel/b")
+	c.Assert(err, IsNil)
+}
+
+func (s *LoadIntegrationSuite) TestCredentialsRejected(c *C) {
+
+	s.cloud.authenticate = func(clientId string, username string) byte {
+		if username == "integration-expired-token" {
+			return connBadCredentials
+		}
+		return connAccepted
+	}
+
+	c.Assert(s.bridge.start(s.cloud.url(), "integration-expired-token"), Equals, ErrBadCredentials)
+
+	select {
+	case ev := <-s.bridge.eventCh:
+		c.Assert(ev.topic, Equals, credentialsRequiredTopic)
+	case <-time.After(brokerWait):
+		c.Fatal("no credentials required event")
+	}
+
+	c.Assert(s.bridge.flags().CredentialsRequired, Equals, true)
+
+	// no retries with the rejected token
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(s.cloud.lastConnect().username, Equals, "integration-expired-token")
+
+	c.Assert(s.bridge.reconfigure("", "integration-fresh-token"), IsNil)
+	s.waitBridged(c)
+
+	c.Assert(s.cloud.lastConnect().username, Equals, "integration-fresh-token")
+	c.Assert(s.bridge.flags().CredentialsRequired, Equals, false)
+}
+
+func (s *LoadIntegrationSuite) TestBusConnect(c *C) {
+
+	conf := &Config{LocalUrl: s.local.url(), SerialNo: "1234"}
+	agent := createAgent(conf)
+	agent.bridge.reconnectDelay = 100 * time.Millisecond
+	s.bridge = agent.bridge
+
+	bus := createBus(conf, agent)
+	go bus.listen()
+	defer bus.stop()
+
+	c.Assert(s.local.waitSubscribed(connectTopic), IsNil)
+
+	req, _ := json.Marshal(&connectRequest{Id: "42", Url: s.cloud.url(), Token: "integration-token"})
+	s.local.publish(connectTopic, req)
+
+	msg, err := s.local.waitPublished(responseTopic)
+	c.Assert(err, IsNil)
+
+	result := &resultStatus{}
+	c.Assert(json.Unmarshal(msg.payload, result), IsNil)
+	c.Assert(result.Id, Equals, "42")
+	c.Assert(result.Configured, Equals, true)
+	c.Assert(result.LastError, Equals, "")
+
+	s.waitBridged(c)
+}
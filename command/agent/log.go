@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+var ErrLogFormat = errors.New("Unknown log format, expected text or json")
+
+// set by -log-format=json, the usual text lines are written while it is nil
+var jsonLog *jsonWriter
+
+// the trace id a bridge tagged a payload with
+var tracePattern = regexp.MustCompile(`"\$mesh-trace"\s*:\s*"([^"\\]*)"`)
+
+// Fields of a structured log line, those which are empty are left out.
+type logFields struct {
+	Component string `json:"component"`
+	Direction string `json:"direction,omitempty"`
+	Rule      string `json:"rule,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Bytes     int    `json:"bytes,omitempty"`
+	Trace     string `json:"trace,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	// the trace is only looked for in the payload when the line is logged
+	payload []byte
+}
+
+type logEntry struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	logFields
+	Message string `json:"msg"`
+}
+
+// The text line for the fields, the same "(local) topic: x ..." the bridge has
+// always logged.
+func (f *logFields) text(message string) string {
+
+	parts := []string{}
+
+	if f.Direction != "" {
+		parts = append(parts, "("+f.Direction+")")
+	}
+	if f.Topic != "" {
+		parts = append(parts, "topic: "+f.Topic)
+	}
+
+	parts = append(parts, message)
+
+	if f.Error != "" {
+		parts = append(parts, f.Error)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// The fields with the error, which may be nil.
+func (f logFields) withError(err error) logFields {
+	if err != nil {
+		f.Error = err.Error()
+	}
+	return f
+}
+
+//
+// Writes every log line as a JSON object on a line of its own, for log shippers
+// which would otherwise have to pick apart the text. Messages, topics and errors
+// are masked the same as the text lines.
+//
+type jsonWriter struct {
+	writer   io.Writer
+	redactor *redactor
+	lock     sync.Mutex
+}
+
+// Lines logged through loggo, which only carry the component.
+func (w *jsonWriter) Write(level loggo.Level, module, filename string, line int, timestamp time.Time, message string) {
+	w.write(level, timestamp, message, logFields{Component: module})
+}
+
+func (w *jsonWriter) write(level loggo.Level, timestamp time.Time, message string, fields logFields) {
+
+	fields.Topic = w.redactor.redact(fields.Topic)
+	fields.Error = w.redactor.redact(fields.Error)
+
+	entry := &logEntry{
+		Time:      timestamp.UTC().Format(time.RFC3339Nano),
+		Level:     level.String(),
+		logFields: fields,
+		Message:   w.redactor.redact(message),
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.writer.Write(append(data, '\n'))
+}
+
+// Turns the paho trace output into JSON lines from the mqtt component.
+type jsonLogWriter struct {
+	json *jsonWriter
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	w.json.write(loggo.TRACE, time.Now(), strings.TrimSpace(string(p)), logFields{Component: "mqtt"})
+	return len(p), nil
+}
+
+// Replaces the default loggo writer with one for the format, text or json, and
+// sends the paho trace the same way.
+func configureLogging(format string, out io.Writer) error {
+
+	switch format {
+	case "text":
+		jsonLog = nil
+		loggo.ReplaceDefaultWriter(&redactingWriter{
+			writer:   loggo.NewSimpleWriter(out, &loggo.DefaultFormatter{}),
+			redactor: logRedactor,
+		})
+		mqttTrace.install(&redactingLogWriter{writer: out, redactor: logRedactor})
+	case "json":
+		jsonLog = &jsonWriter{writer: out, redactor: logRedactor}
+		loggo.ReplaceDefaultWriter(jsonLog)
+		mqttTrace.install(&jsonLogWriter{json: jsonLog})
+	default:
+		return ErrLogFormat
+	}
+
+	return nil
+}
+
+// Logs a line with its fields, as JSON when that's enabled otherwise as text.
+func logEvent(logger loggo.Logger, level loggo.Level, fields logFields, format string, args ...interface{}) {
+
+	if !logger.IsLevelEnabled(level) {
+		return
+	}
+
+	if fields.Trace == "" && fields.payload != nil {
+		fields.Trace = traceOf(fields.payload)
+	}
+
+	message := fmt.Sprintf(format, args...)
+
+	if jsonLog != nil {
+		fields.Component = logger.Name()
+		jsonLog.write(level, time.Now(), message, fields)
+		return
+	}
+
+	logger.LogCallf(2, level, "%s", fields.text(message))
+}
+
+// 64 random bits, plenty to pick one message out of the logs.
+func createTraceId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// The trace id in a payload, "" if it doesn't have one.
+func traceOf(payload []byte) string {
+	if match := tracePattern.FindSubmatch(payload); match != nil {
+		return string(match[1])
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	. "launchpad.net/gocheck"
+)
+
+type LoadLogSuite struct {
+	out *bytes.Buffer
+	log loggo.Logger
+}
+
+var _ = Suite(&LoadLogSuite{})
+
+func (s *LoadLogSuite) SetUpTest(c *C) {
+	s.out = &bytes.Buffer{}
+	s.log = loggo.GetLogger("log-test")
+	s.log.SetLogLevel(loggo.DEBUG)
+}
+
+func (s *LoadLogSuite) TearDownTest(c *C) {
+	jsonLog = nil
+}
+
+// Decodes each JSON line written so far.
+func (s *LoadLogSuite) entries(c *C) []map[string]interface{} {
+	entries := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(s.out.String()), "\n") {
+		entry := map[string]interface{}{}
+		c.Assert(json.Unmarshal([]byte(line), &entry), IsNil, Commentf(line))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Only collects the lines from one logger.
+type moduleWriter struct {
+	module string
+	captureWriter
+}
+
+func (w *moduleWriter) Write(level loggo.Level, module, filename string, line int, timestamp time.Time, message string) {
+	if module == w.module {
+		w.captureWriter.Write(level, module, filename, line, timestamp, message)
+	}
+}
+
+func (s *LoadLogSuite) TestText(c *C) {
+
+	writer := &moduleWriter{module: "log-test"}
+	c.Assert(loggo.RegisterWriter("log-test", writer, loggo.TRACE), IsNil)
+	defer loggo.RemoveWriter("log-test")
+
+	msg := &bridgeMessage{topic: "$device/a/channel/b", payload: []byte(`{}`)}
+	topic := replaceTopic{on: "$device/+/channel/+"}
+
+	logEvent(s.log, loggo.DEBUG, ruleFields("local", topic, msg, nil), "updated: %s len: %d", "$cloud/device/a/channel/b", 2)
+	logEvent(s.log, loggo.WARNING, ruleFields("cloud", topic, msg, errors.New("bad key")), "dropped")
+	logEvent(s.log, loggo.TRACE, msgFields("local", msg), "not logged")
+
+	c.Assert(writer.messages, DeepEquals, []string{
+		"(local) topic: $device/a/channel/b updated: $cloud/device/a/channel/b len: 2",
+		"(cloud) topic: $device/a/channel/b dropped bad key",
+	})
+}
+
+func (s *LoadLogSuite) TestJSON(c *C) {
+
+	redactor := createRedactor(defaultRedactFields)
+	redactor.addSecret("log-secret")
+
+	jsonLog = &jsonWriter{writer: s.out, redactor: redactor}
+
+	payload := []byte(`{"$mesh-source":"1234", "$mesh-trace":"0123456789abcdef", "params":[1]}`)
+	msg := &bridgeMessage{topic: "$device/log-secret/channel/b", payload: payload}
+
+	logEvent(s.log, loggo.WARNING, ruleFields("local", replaceTopic{on: "$device/+/channel/+"}, msg, errors.New("refused log-secret")), "publish failed")
+	logEvent(s.log, loggo.TRACE, msgFields("local", msg), "not logged")
+
+	// plain loggo lines only have the component
+	jsonLog.Write(loggo.INFO, "bus", "bus.go", 1, time.Date(2014, 9, 1, 12, 0, 0, 0, time.UTC), "connected")
+
+	entries := s.entries(c)
+	c.Assert(entries, HasLen, 2)
+
+	c.Assert(entries[0]["level"], Equals, "WARNING")
+	c.Assert(entries[0]["component"], Equals, "log-test")
+	c.Assert(entries[0]["direction"], Equals, "local")
+	c.Assert(entries[0]["rule"], Equals, "$device/+/channel/+")
+	c.Assert(entries[0]["topic"], Equals, "$device/[REDACTED]/channel/b")
+	c.Assert(entries[0]["bytes"], Equals, float64(len(payload)))
+	c.Assert(entries[0]["trace"], Equals, "0123456789abcdef")
+	c.Assert(entries[0]["error"], Equals, "refused [REDACTED]")
+	c.Assert(entries[0]["msg"], Equals, "publish failed")
+
+	c.Assert(entries[1], DeepEquals, map[string]interface{}{
+		"time":      "2014-09-01T12:00:00Z",
+		"level":     "INFO",
+		"component": "bus",
+		"msg":       "connected",
+	})
+}
+
+func (s *LoadLogSuite) TestTraceIds(c *C) {
+
+	local := createFakeBroker()
+	cloud := createFakeBroker()
+
+	bridge := createBridge(&Config{LocalUrl: fakeLocalUrl, SerialNo: "1234"})
+	bridge.newClient = fakeClients(map[string]*fakeBroker{fakeLocalUrl: local, fakeCloudUrl: cloud})
+	bridge.reconnectDelay = time.Hour
+
+	c.Assert(bridge.start(fakeCloudUrl, "log-token"), IsNil)
+	defer bridge.stop()
+
+	local.publish("$device/a/channel/b", []byte(`{"params":[1]}`))
+	local.publish("$device/a/channel/b", []byte(`{"params":[2]}`))
+
+	msgs := cloud.publishedOn("$cloud/device/a/channel/b")
+	c.Assert(msgs, HasLen, 2)
+
+	first, second := traceOf(msgs[0].payload), traceOf(msgs[1].payload)
+	c.Assert(first, Matches, "[0-9a-f]{16}")
+	c.Assert(second, Matches, "[0-9a-f]{16}")
+	c.Assert(first, Not(Equals), second)
+
+	// a message tagged further up keeps its trace all the way down
+	cloud.publish("$cloud/device/a/channel/b/reply", []byte(`{"$mesh-source":"phone", "$mesh-trace":"from-phone", "result":true}`))
+
+	msgs = local.publishedOn("$device/a/channel/b/reply")
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(traceOf(msgs[0].payload), Equals, "from-phone")
+
+	c.Assert(traceOf([]byte(`{"params":[1]}`)), Equals, "")
+}
+
+func (s *LoadLogSuite) TestFormat(c *C) {
+	c.Assert(configureLogging("xml", s.out), Equals, ErrLogFormat)
+	c.Assert(jsonLog, IsNil)
+}
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/juju/loggo"
+)
+
+var ErrLogModule = errors.New("Unknown log module")
+var ErrLogLevel = errors.New("Unknown log level")
+
+// the loggers whose level can be changed over the bus, root sets the default
+var logModules = map[string]string{
+	"root":    "",
+	"agent":   "agent",
+	"audit":   "audit",
+	"bridge":  "bridge",
+	"bus":     "bus",
+	"capture": "capture",
+	"health":  "health",
+	"notify":  "notify",
+	"rules":   "rules",
+}
+
+// paho's trace output, switched on by -trace or over the bus
+var mqttTrace = &traceWriter{}
+
+// Passes the paho trace loggers' output on while enabled, paho reads its loggers
+// without locking so they are set once and their output is switched instead. While
+// disabled they write to ioutil.Discard, which log skips without formatting.
+type traceWriter struct {
+	out     io.Writer
+	enabled bool
+	loggers []*log.Logger
+	lock    sync.RWMutex
+
+	// several paho goroutines trace at once, so out is written one at a time
+	writeLock sync.Mutex
+}
+
+// paho's goroutines read these from the start, so they must never be reassigned
+func init() {
+	for _, l := range []**log.Logger{&mqtt.DEBUG, &mqtt.ERROR, &mqtt.CRITICAL, &mqtt.WARN} {
+		*l = log.New(ioutil.Discard, "", 0)
+		mqttTrace.loggers = append(mqttTrace.loggers, *l)
+	}
+}
+
+// Sends the trace to out when enabled, nil discards it.
+func (w *traceWriter) install(out io.Writer) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.out = out
+	w.route()
+}
+
+func (w *traceWriter) setEnabled(enabled bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.enabled = enabled
+	w.route()
+}
+
+func (w *traceWriter) isEnabled() bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.enabled
+}
+
+// Points the loggers at the writer while there is somewhere to trace to, called
+// under lock.
+func (w *traceWriter) route() {
+	var out io.Writer = ioutil.Discard
+	if w.enabled && w.out != nil {
+		out = w
+	}
+	for _, l := range w.loggers {
+		l.SetOutput(out)
+	}
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	w.lock.RLock()
+	out := w.out
+	if !w.enabled {
+		out = nil
+	}
+	w.lock.RUnlock()
+
+	// a line formatted just before tracing was switched off
+	if out == nil {
+		return len(p), nil
+	}
+
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+	return out.Write(p)
+}
+
+//
+// Changes log levels while the agent runs so debug logs can be had from a sphere
+// without restarting it. A change can revert after a while, back to the levels
+// the agent was started with, so debug logging isn't left on by accident.
+//
+type logControl struct {
+	trace *traceWriter
+
+	// as started, what a revert goes back to
+	levels map[string]loggo.Level
+	traced bool
+
+	// bumped by every change, so a revert that fires late doesn't undo a newer one
+	generation int
+	revert     *time.Timer
+
+	log  loggo.Logger
+	lock sync.Mutex
+}
+
+func createLogControl(trace *traceWriter) *logControl {
+
+	l := &logControl{trace: trace, levels: make(map[string]loggo.Level), traced: trace.isEnabled(), log: loggo.GetLogger("agent")}
+
+	for _, module := range logModules {
+		l.levels[module] = loggo.GetLogger(module).LogLevel()
+	}
+
+	return l
+}
+
+// Applies the request's levels and tracing, nothing is changed if any of it is
+// invalid. With a revert the startup levels come back after that long, otherwise
+// the change stays and any pending revert is cancelled.
+func (l *logControl) apply(req *logRequest) error {
+
+	levels := make(map[string]loggo.Level)
+
+	for name, value := range req.Levels {
+		module, ok := logModules[name]
+		if !ok {
+			return fmt.Errorf("%s %s", ErrLogModule, name)
+		}
+		level, ok := loggo.ParseLevel(value)
+		if !ok {
+			return fmt.Errorf("%s %s", ErrLogLevel, value)
+		}
+		levels[module] = level
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for module, level := range levels {
+		loggo.GetLogger(module).SetLogLevel(level)
+	}
+
+	if req.Trace != nil {
+		l.trace.setEnabled(*req.Trace)
+	}
+
+	if l.revert != nil {
+		l.revert.Stop()
+		l.revert = nil
+	}
+
+	l.generation++
+
+	if req.Revert > 0 {
+		generation := l.generation
+		l.revert = time.AfterFunc(time.Duration(req.Revert)*time.Second, func() {
+			l.reset(generation)
+		})
+	}
+
+	l.log.Infof("log levels changed to %s trace: %t revert: %ds", req.Levels, l.trace.isEnabled(), req.Revert)
+
+	return nil
+}
+
+// Puts the startup levels and tracing back, unless there's been another change
+// since the one being reverted.
+func (l *logControl) reset(generation int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if generation != l.generation {
+		return
+	}
+
+	for module, level := range l.levels {
+		loggo.GetLogger(module).SetLogLevel(level)
+	}
+
+	l.trace.setEnabled(l.traced)
+	l.revert = nil
+
+	l.log.Infof("log levels reverted")
+}
+
+// The module names and levels in the request, sorted so they can be signed.
+func (r *logRequest) sortedLevels() string {
+
+	levels := []string{}
+
+	for module, level := range r.Levels {
+		levels = append(levels, module+"="+level)
+	}
+
+	sort.Strings(levels)
+
+	return strings.Join(levels, ",")
+}
+
+func (r *logRequest) traceField() string {
+	if r.Trace == nil {
+		return ""
+	}
+	return strconv.FormatBool(*r.Trace)
+}
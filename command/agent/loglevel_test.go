@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/juju/loggo"
+	. "launchpad.net/gocheck"
+)
+
+type LoadLogLevelSuite struct {
+	trace    *traceWriter
+	logs     *logControl
+	previous map[string]loggo.Level
+}
+
+var _ = Suite(&LoadLogLevelSuite{})
+
+func (s *LoadLogLevelSuite) SetUpTest(c *C) {
+	s.trace = &traceWriter{}
+	s.logs = createLogControl(s.trace)
+}
+
+// Other suites share the loggers, so leave them as they were.
+func (s *LoadLogLevelSuite) TearDownTest(c *C) {
+	s.logs.reset(s.logs.generation)
+}
+
+func on(b bool) *bool {
+	return &b
+}
+
+func (s *LoadLogLevelSuite) TestApply(c *C) {
+
+	before := loggo.GetLogger("bus").LogLevel()
+
+	err := s.logs.apply(&logRequest{Levels: map[string]string{"bridge": "DEBUG", "agent": "trace"}, Trace: on(true)})
+	c.Assert(err, IsNil)
+
+	c.Assert(loggo.GetLogger("bridge").LogLevel(), Equals, loggo.DEBUG)
+	c.Assert(loggo.GetLogger("agent").LogLevel(), Equals, loggo.TRACE)
+	c.Assert(loggo.GetLogger("bus").LogLevel(), Equals, before)
+	c.Assert(s.trace.isEnabled(), Equals, true)
+
+	// leaving trace out leaves it alone
+	c.Assert(s.logs.apply(&logRequest{Levels: map[string]string{"bridge": "INFO"}}), IsNil)
+	c.Assert(loggo.GetLogger("bridge").LogLevel(), Equals, loggo.INFO)
+	c.Assert(s.trace.isEnabled(), Equals, true)
+	c.Assert(s.logs.revert, IsNil)
+}
+
+func (s *LoadLogLevelSuite) TestInvalid(c *C) {
+
+	before := loggo.GetLogger("bridge").LogLevel()
+
+	err := s.logs.apply(&logRequest{Levels: map[string]string{"bridge": "DEBUG", "paho": "DEBUG"}})
+	c.Assert(err, ErrorMatches, "Unknown log module paho")
+
+	err = s.logs.apply(&logRequest{Levels: map[string]string{"bridge": "DEBUG", "bus": "LOUD"}, Trace: on(true)})
+	c.Assert(err, ErrorMatches, "Unknown log level LOUD")
+
+	// none of it was applied
+	c.Assert(loggo.GetLogger("bridge").LogLevel(), Equals, before)
+	c.Assert(s.trace.isEnabled(), Equals, false)
+}
+
+func (s *LoadLogLevelSuite) TestRevert(c *C) {
+
+	before := loggo.GetLogger("bridge").LogLevel()
+
+	c.Assert(s.logs.apply(&logRequest{Levels: map[string]string{"bridge": "DEBUG"}, Trace: on(true), Revert: 1}), IsNil)
+	c.Assert(s.logs.revert, NotNil)
+
+	reverted := func() bool {
+		return loggo.GetLogger("bridge").LogLevel() == before && !s.trace.isEnabled()
+	}
+	c.Assert(waitFor(reverted, 3*time.Second), Equals, true)
+
+	// a revert that fires after a newer change leaves it be
+	c.Assert(s.logs.apply(&logRequest{Levels: map[string]string{"bridge": "DEBUG"}, Revert: 3600}), IsNil)
+	stale := s.logs.generation
+
+	c.Assert(s.logs.apply(&logRequest{Levels: map[string]string{"bridge": "TRACE"}}), IsNil)
+	c.Assert(s.logs.revert, IsNil)
+
+	s.logs.reset(stale)
+	c.Assert(loggo.GetLogger("bridge").LogLevel(), Equals, loggo.TRACE)
+}
+
+func (s *LoadLogLevelSuite) TestTraceWriter(c *C) {
+
+	// the paho loggers are never reassigned, so swap what mqttTrace writes to
+	enabled := mqttTrace.isEnabled()
+	mqttTrace.setEnabled(false)
+	defer mqttTrace.setEnabled(enabled)
+
+	out := &bytes.Buffer{}
+	mqttTrace.install(out)
+	defer mqttTrace.install(nil)
+
+	// nothing is formatted while tracing is off
+	c.Assert(mqtt.DEBUG.Writer(), Equals, ioutil.Discard)
+	mqtt.DEBUG.Println("dropped")
+	c.Assert(out.String(), Equals, "")
+
+	mqttTrace.setEnabled(true)
+	mqtt.WARN.Println("kept")
+	mqttTrace.setEnabled(false)
+	c.Assert(out.String(), Matches, "(?s)(.*\n)?kept\n")
+}
+
+func (s *LoadLogLevelSuite) TestRequest(c *C) {
+
+	broker := createFakeBroker()
+	conf := &Config{LocalUrl: fakeLocalUrl, ControlSecret: "log-control-secret"}
+
+	agent := createAgent(conf)
+	agent.logs = s.logs
+
+	bus := createBus(conf, agent)
+	bus.client = fakeClients(map[string]*fakeBroker{fakeLocalUrl: broker})(&clientOptions{server: fakeLocalUrl})
+	c.Assert(bus.client.connect(), IsNil)
+
+	result := func() *resultStatus {
+		msgs := broker.publishedOn(responseTopic)
+		res := &resultStatus{}
+		c.Assert(json.Unmarshal(msgs[len(msgs)-1].payload, res), IsNil)
+		return res
+	}
+
+	req := &logRequest{Id: "1", Levels: map[string]string{"bus": "DEBUG", "bridge": "DEBUG"}, Trace: on(true), Revert: 600}
+	signControlRequest(req, []byte("log-control-secret"), logTopic, time.Now())
+
+	bus.handleLog(bus.client, &bridgeMessage{topic: logTopic, payload: bus.encodeRequest(req)})
+	c.Assert(result(), DeepEquals, &resultStatus{Id: "1"})
+	c.Assert(loggo.GetLogger("bus").LogLevel(), Equals, loggo.DEBUG)
+	c.Assert(s.trace.isEnabled(), Equals, true)
+
+	// the levels are covered by the signature
+	req = &logRequest{Id: "2", Levels: map[string]string{"bus": "DEBUG"}}
+	signControlRequest(req, []byte("log-control-secret"), logTopic, time.Now())
+	req.Levels["root"] = "TRACE"
+
+	bus.handleLog(bus.client, &bridgeMessage{topic: logTopic, payload: bus.encodeRequest(req)})
+	c.Assert(result().LastError, Equals, ErrBadSignature.Error())
+}
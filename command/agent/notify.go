@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+//
+// Speaks systemd's sd_notify protocol, datagrams of newline separated assignments
+// sent to the unix socket named in NOTIFY_SOCKET. Without that variable, as when
+// not run by systemd, every notification is quietly dropped.
+//
+// When the unit sets WatchdogSec systemd passes the timeout in WATCHDOG_USEC and
+// expects WATCHDOG=1 at least that often, we send it at half the timeout while the
+// agent is alive and stop when it isn't so systemd restarts us.
+//
+type notifier struct {
+	socket   string
+	watchdog time.Duration
+	log      loggo.Logger
+}
+
+// Reads the systemd environment through getenv, usually os.Getenv.
+func createNotifier(getenv func(string) string, pid int) *notifier {
+
+	n := &notifier{socket: getenv("NOTIFY_SOCKET"), log: loggo.GetLogger("notify")}
+
+	usec, err := strconv.ParseInt(getenv("WATCHDOG_USEC"), 10, 64)
+
+	if err != nil || usec <= 0 {
+		return n
+	}
+
+	// the watchdog may be meant for another process
+	if watchPid := getenv("WATCHDOG_PID"); watchPid != "" && watchPid != strconv.Itoa(pid) {
+		return n
+	}
+
+	n.watchdog = time.Duration(usec) * time.Microsecond
+
+	return n
+}
+
+func (n *notifier) enabled() bool {
+	return n.socket != ""
+}
+
+func (n *notifier) notify(state string) error {
+
+	if !n.enabled() {
+		return nil
+	}
+
+	// a leading @ is an abstract socket, which net handles for us
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+func (n *notifier) ready() {
+	if err := n.notify("READY=1"); err != nil {
+		n.log.Warningf("Unable to notify systemd %s", err)
+	}
+}
+
+//
+// Keeps systemd up to date until stop is closed, STATUS= whenever the bridge's
+// state changes and WATCHDOG=1 while the agent is alive.
+//
+func (n *notifier) watch(agent *Agent, bus *Bus, stop <-chan struct{}) {
+
+	interval := 5 * time.Second
+	if n.watchdog > 0 {
+		interval = n.watchdog / 2
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	status := ""
+
+	for {
+		now := time.Now()
+
+		if current := bridgeState(agent.bridge); current != status {
+			status = current
+			n.notify("STATUS=" + status)
+		}
+
+		if n.watchdog > 0 {
+			if problems := liveness(agent, bus, now); len(problems) == 0 {
+				n.notify("WATCHDOG=1")
+			} else {
+				n.log.Warningf("Withholding the watchdog ping %s", problems)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// A line describing the bridge for systemctl status.
+func bridgeState(bridge *Bridge) string {
+
+	flags := bridge.flags()
+	local, cloud := bridge.legsConnected()
+
+	switch {
+	case !flags.Configured:
+		return "not configured"
+	case flags.CredentialsRequired:
+		return "waiting for new credentials for " + bridge.endpoint()
+	case local && cloud:
+		return "bridging to " + bridge.endpoint()
+	}
+
+	lastError := ""
+	if flags.LastError != nil {
+		lastError = ", " + logRedactor.redactError(flags.LastError)
+	}
+
+	return fmt.Sprintf("reconnecting to %s, local: %t cloud: %t%s", bridge.endpoint(), local, cloud, lastError)
+}
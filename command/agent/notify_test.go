@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadNotifySuite struct {
+	socket *net.UnixConn
+	env    map[string]string
+}
+
+var _ = Suite(&LoadNotifySuite{})
+
+// Stands in for systemd, listening on a socket in a temporary directory.
+func (s *LoadNotifySuite) SetUpTest(c *C) {
+	path := filepath.Join(c.MkDir(), "notify")
+
+	socket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+
+	s.socket = socket
+	s.env = map[string]string{"NOTIFY_SOCKET": path}
+}
+
+func (s *LoadNotifySuite) TearDownTest(c *C) {
+	s.socket.Close()
+}
+
+func (s *LoadNotifySuite) getenv(name string) string {
+	return s.env[name]
+}
+
+// Returns the next notification, or "" if none arrives within the wait.
+func (s *LoadNotifySuite) receive(wait time.Duration) string {
+	buf := make([]byte, 1024)
+	s.socket.SetReadDeadline(time.Now().Add(wait))
+	n, err := s.socket.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+// Skips watchdog pings sent before the status changed.
+func (s *LoadNotifySuite) receiveStatus() string {
+	for {
+		msg := s.receive(time.Second)
+		if msg != "WATCHDOG=1" {
+			return msg
+		}
+	}
+}
+
+func (s *LoadNotifySuite) TestEnvironment(c *C) {
+
+	n := createNotifier(func(string) string { return "" }, 42)
+	c.Assert(n.enabled(), Equals, false)
+	c.Assert(n.notify("READY=1"), IsNil)
+
+	s.env["WATCHDOG_USEC"] = "20000000"
+	c.Assert(createNotifier(s.getenv, 42).watchdog, Equals, 20*time.Second)
+
+	s.env["WATCHDOG_PID"] = "42"
+	c.Assert(createNotifier(s.getenv, 42).watchdog, Equals, 20*time.Second)
+
+	// meant for someone else
+	s.env["WATCHDOG_PID"] = "43"
+	c.Assert(createNotifier(s.getenv, 42).watchdog, Equals, time.Duration(0))
+
+	s.env["WATCHDOG_PID"] = ""
+	s.env["WATCHDOG_USEC"] = "soon"
+	c.Assert(createNotifier(s.getenv, 42).watchdog, Equals, time.Duration(0))
+}
+
+func (s *LoadNotifySuite) TestReady(c *C) {
+
+	n := createNotifier(s.getenv, 42)
+	c.Assert(n.enabled(), Equals, true)
+
+	n.ready()
+	c.Assert(s.receive(time.Second), Equals, "READY=1")
+}
+
+func (s *LoadNotifySuite) TestWatch(c *C) {
+
+	local := createFakeBroker()
+	cloud := createFakeBroker()
+	clients := fakeClients(map[string]*fakeBroker{fakeLocalUrl: local, fakeCloudUrl: cloud})
+
+	conf := &Config{LocalUrl: fakeLocalUrl}
+	agent := createAgent(conf)
+	agent.bridge.newClient = clients
+	agent.bridge.reconnectDelay = time.Hour
+
+	bus := createBus(conf, agent)
+	bus.client = clients(&clientOptions{server: fakeLocalUrl})
+	c.Assert(bus.client.connect(), IsNil)
+	bus.touch()
+
+	// pings every 50ms
+	s.env["WATCHDOG_USEC"] = "100000"
+	n := createNotifier(s.getenv, 42)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go n.watch(agent, bus, stop)
+
+	c.Assert(s.receive(time.Second), Equals, "STATUS=not configured")
+	c.Assert(s.receive(time.Second), Equals, "WATCHDOG=1")
+	c.Assert(s.receive(time.Second), Equals, "WATCHDOG=1")
+
+	c.Assert(agent.bridge.start(fakeCloudUrl, "notify-token"), IsNil)
+	defer agent.bridge.stop()
+
+	c.Assert(s.receiveStatus(), Equals, "STATUS=bridging to ssl://cloud:8883")
+
+	// a dead bus stops the pings, status changes still go out
+	bus.client.disconnect()
+	cloud.drop(ErrNotConnected)
+
+	c.Assert(s.receiveStatus(), Equals, "STATUS=reconnecting to ssl://cloud:8883, local: false cloud: false, Not Connected")
+
+	for msg := s.receive(200 * time.Millisecond); msg != ""; msg = s.receive(200 * time.Millisecond) {
+		c.Assert(strings.HasPrefix(msg, "WATCHDOG"), Equals, false, Commentf("got %s", msg))
+	}
+}
+
+func (s *LoadNotifySuite) TestHung(c *C) {
+
+	bridge := createBridge(&Config{})
+	now := time.Now()
+
+	c.Assert(bridge.hung(now), Equals, false)
+
+	bridge.setLossSince(now)
+	c.Assert(bridge.hung(now.Add(lossWatchdog/2)), Equals, false)
+	c.Assert(bridge.hung(now.Add(2*lossWatchdog)), Equals, true)
+
+	bridge.setLossSince(time.Time{})
+	c.Assert(bridge.hung(now.Add(2*lossWatchdog)), Equals, false)
+}
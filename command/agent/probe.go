@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrProbeFailed = errors.New("Probes are not making the round trip")
+
+// how many round trips the latency percentiles are taken over
+const probeWindow = 100
+
+//
+// Checks messages really make it across the bridge, paho only notices a dead
+// connection once pings go unanswered and a half open connection can pass for a
+// live one far longer.
+//
+// Each probe is published to the local broker on $sphere/bridge/probe/<serial>,
+// picked up by the bridge and published to the cloud on $cloud/bridge/probe/<serial>,
+// which the bridge is also subscribed to. The time until it comes back is the round
+// trip. Probes which aren't back within the timeout are lost, and enough of them in
+// a row are treated as a lost connection.
+//
+type prober struct {
+	interval  time.Duration
+	timeout   time.Duration
+	failLimit int
+
+	localTopic string
+	cloudTopic string
+
+	nextId   int64
+	pending  map[int64]time.Time
+	samples  []time.Duration
+	failures int
+
+	Sent int64
+	Lost int64
+
+	lock sync.Mutex
+}
+
+type probeMessage struct {
+	Id int64 `json:"id"`
+}
+
+// round trip latency in milliseconds
+type probeStats struct {
+	Sent int64
+	Lost int64
+	P50  float64
+	P90  float64
+	P99  float64
+}
+
+func createProber(conf *Config) *prober {
+	return &prober{
+		interval:   time.Duration(conf.ProbeInterval) * time.Second,
+		timeout:    time.Duration(conf.ProbeTimeout) * time.Second,
+		failLimit:  conf.ProbeFailures,
+		localTopic: "$sphere/bridge/probe/" + conf.SerialNo,
+		cloudTopic: "$cloud/bridge/probe/" + conf.SerialNo,
+		pending:    make(map[int64]time.Time),
+	}
+}
+
+// The probe topic the client for the direction subscribes to.
+func (p *prober) topic(tag string) string {
+	if tag == "cloud" {
+		return p.cloudTopic
+	}
+	return p.localTopic
+}
+
+// Starts a new probe, returning its payload.
+func (p *prober) send(now time.Time) []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.nextId++
+	p.pending[p.nextId] = now
+	p.Sent++
+
+	payload, _ := json.Marshal(&probeMessage{Id: p.nextId})
+	return payload
+}
+
+// Records a probe which made it back, probes we didn't send or already gave up on
+// are ignored.
+func (p *prober) received(payload []byte, now time.Time) {
+
+	msg := &probeMessage{}
+	if json.Unmarshal(payload, msg) != nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sent, ok := p.pending[msg.Id]
+	if !ok {
+		return
+	}
+
+	delete(p.pending, msg.Id)
+
+	p.failures = 0
+	p.samples = append(p.samples, now.Sub(sent))
+	if len(p.samples) > probeWindow {
+		p.samples = p.samples[1:]
+	}
+}
+
+// Gives up on probes older than the timeout, reporting whether too many in a row
+// have now been lost.
+func (p *prober) expire(now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for id, sent := range p.pending {
+		if now.Sub(sent) >= p.timeout {
+			delete(p.pending, id)
+			p.Lost++
+			p.failures++
+		}
+	}
+
+	return p.failures >= p.failLimit
+}
+
+// Forgets probes in flight and past failures, for a fresh connection.
+func (p *prober) reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pending = make(map[int64]time.Time)
+	p.failures = 0
+}
+
+func (p *prober) stats() probeStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sorted := append([]time.Duration{}, p.samples...)
+	sort.Sort(durations(sorted))
+
+	return probeStats{
+		Sent: p.Sent,
+		Lost: p.Lost,
+		P50:  percentile(sorted, 50),
+		P90:  percentile(sorted, 90),
+		P99:  percentile(sorted, 99),
+	}
+}
+
+// Nearest rank percentile of sorted durations in milliseconds, 0 when there are none.
+func percentile(sorted []time.Duration, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return float64(sorted[rank-1]) / float64(time.Millisecond)
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadProbeSuite struct {
+	local  *fakeBroker
+	cloud  *fakeBroker
+	bridge *Bridge
+}
+
+var _ = Suite(&LoadProbeSuite{})
+
+func (s *LoadProbeSuite) SetUpTest(c *C) {
+	s.local = createFakeBroker()
+	s.cloud = createFakeBroker()
+
+	s.bridge = createBridge(&Config{LocalUrl: fakeLocalUrl, SerialNo: "1234", ProbeInterval: 3600, ProbeTimeout: 10, ProbeFailures: 3})
+	s.bridge.newClient = fakeClients(map[string]*fakeBroker{fakeLocalUrl: s.local, fakeCloudUrl: s.cloud})
+	s.bridge.reconnectDelay = 10 * time.Millisecond
+	s.bridge.eventCh = make(chan bridgeEvent, 10)
+}
+
+func (s *LoadProbeSuite) TearDownTest(c *C) {
+	if s.bridge.flags().Configured {
+		s.bridge.stop()
+	}
+}
+
+func (s *LoadProbeSuite) TestRoundTrip(c *C) {
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "probe-token"), IsNil)
+	c.Assert(s.local.subscribed("$sphere/bridge/probe/1234"), Equals, true)
+	c.Assert(s.cloud.subscribed("$cloud/bridge/probe/1234"), Equals, true)
+
+	s.bridge.probe()
+
+	c.Assert(s.local.publishedOn("$sphere/bridge/probe/1234"), HasLen, 1)
+	c.Assert(s.cloud.publishedOn("$cloud/bridge/probe/1234"), HasLen, 1)
+
+	// probes aren't forwarded by the rules
+	c.Assert(s.cloud.publishedOn("$cloud/sphere/#"), HasLen, 0)
+	c.Assert(s.bridge.EgressCounter, Equals, int64(0))
+
+	stats := s.bridge.probeStats()
+	c.Assert(stats.Sent, Equals, int64(1))
+	c.Assert(stats.Lost, Equals, int64(0))
+	c.Assert(len(s.bridge.prober.samples), Equals, 1)
+	c.Assert(len(s.bridge.prober.pending), Equals, 0)
+}
+
+func (s *LoadProbeSuite) TestLostProbesReconnect(c *C) {
+
+	c.Assert(s.bridge.start(fakeCloudUrl, "probe-token"), IsNil)
+
+	// a half open connection, publishes go nowhere
+	s.bridge.prober.timeout = 0
+	s.cloud.loseMessages(true)
+
+	for i := 0; i < 3; i++ {
+		s.bridge.probe()
+		c.Assert(s.bridge.flags().Connected, Equals, true)
+	}
+
+	// the third loss is one too many
+	s.bridge.probe()
+	c.Assert(s.bridge.flags().Connected, Equals, false)
+	c.Assert(s.bridge.flags().LastError, Equals, ErrProbeFailed)
+	c.Assert(s.bridge.probeStats().Lost, Equals, int64(3))
+
+	s.cloud.loseMessages(false)
+	c.Assert(waitFor(s.bridge.IsConnected, time.Second), Equals, true)
+
+	s.bridge.prober.timeout = time.Minute
+	s.bridge.probe()
+	c.Assert(s.bridge.flags().Connected, Equals, true)
+	c.Assert(s.bridge.prober.failures, Equals, 0)
+}
+
+func (s *LoadProbeSuite) TestProber(c *C) {
+
+	p := createProber(&Config{SerialNo: "1234", ProbeTimeout: 10, ProbeFailures: 2})
+	now := time.Now()
+
+	first := p.send(now)
+	second := p.send(now)
+	c.Assert(string(first), Equals, `{"id":1}`)
+
+	p.received(second, now.Add(20*time.Millisecond))
+
+	// unknown and repeated probes are ignored
+	p.received([]byte(`{"id":99}`), now)
+	p.received(second, now.Add(time.Second))
+	p.received([]byte(`nonsense`), now)
+
+	c.Assert(p.expire(now.Add(5*time.Second)), Equals, false)
+	c.Assert(p.expire(now.Add(10*time.Second)), Equals, false)
+	c.Assert(p.Lost, Equals, int64(1))
+
+	// came back too late
+	p.received(first, now.Add(11*time.Second))
+
+	p.send(now)
+	c.Assert(p.expire(now.Add(10*time.Second)), Equals, true)
+
+	p.reset()
+	c.Assert(p.expire(now.Add(time.Hour)), Equals, false)
+
+	stats := p.stats()
+	c.Assert(stats.Sent, Equals, int64(3))
+	c.Assert(stats.Lost, Equals, int64(2))
+	c.Assert(stats.P50, Equals, 20.0)
+}
+
+func (s *LoadProbeSuite) TestPercentiles(c *C) {
+
+	p := createProber(&Config{})
+
+	c.Assert(p.stats().P50, Equals, 0.0)
+
+	// one to a hundred ms, out of order, after older samples fall out of the window
+	for i := 0; i < 50; i++ {
+		p.samples = append(p.samples, time.Hour)
+	}
+	for i := 100; i > 0; i-- {
+		p.samples = append(p.samples, time.Duration(i)*time.Millisecond)
+		if len(p.samples) > probeWindow {
+			p.samples = p.samples[1:]
+		}
+	}
+
+	stats := p.stats()
+	c.Assert(stats.P50, Equals, 50.0)
+	c.Assert(stats.P90, Equals, 90.0)
+	c.Assert(stats.P99, Equals, 99.0)
+
+	c.Assert(percentile([]time.Duration{time.Millisecond}, 99), Equals, 1.0)
+}
+
+func (s *LoadProbeSuite) TestReport(c *C) {
+
+	agent := createAgent(&Config{SerialNo: "1234", ProbeInterval: 30, ProbeTimeout: 10})
+	agent.bridge.prober.samples = []time.Duration{20 * time.Millisecond}
+	agent.bridge.prober.Sent = 2
+	agent.bridge.prober.Lost = 1
+
+	report := agent.getReport("abc")
+	c.Assert(report.ProbeSent, Equals, int64(2))
+	c.Assert(report.ProbeLatencyP99, Equals, 20.0)
+
+	out := formatReport(report)
+	c.Assert(strings.Contains(out, "probes             2 sent, 1 lost"), Equals, true, Commentf(out))
+	c.Assert(strings.Contains(out, "round trip         p50 20.0ms p90 20.0ms p99 20.0ms"), Equals, true, Commentf(out))
+
+	// nothing about probes when they're off
+	c.Assert(strings.Contains(formatReport(createAgent(&Config{}).getReport("abc")), "probes"), Equals, false)
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+// ReplayCommand publishes the messages in capture files to a broker, with the
+// timing they were captured with.
+type ReplayCommand struct {
+	Ui cli.Ui
+
+	// paho unless a test says otherwise
+	newClient clientFactory
+}
+
+func (c *ReplayCommand) Run(args []string) int {
+
+	var url, direction string
+	var speed float64
+	var rewritten bool
+
+	cmdFlags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&url, "url", "tcp://localhost:1883", "URL for the broker to publish to")
+	cmdFlags.Float64Var(&speed, "speed", 1, "multiple of the captured speed, 0 publishes without waiting")
+	cmdFlags.StringVar(&direction, "direction", "", "only replay messages from local or cloud")
+	cmdFlags.BoolVar(&rewritten, "rewritten", false, "publish on the rewritten topics instead of the originals")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return exitFailed
+	}
+
+	files := cmdFlags.Args()
+
+	if len(files) == 0 || speed < 0 || (direction != "" && direction != "local" && direction != "cloud") {
+		c.Ui.Error(c.Help())
+		return exitFailed
+	}
+
+	for _, name := range files {
+		if _, err := os.Stat(name); err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to replay %s", err))
+			return exitFailed
+		}
+	}
+
+	newClient := c.newClient
+	if newClient == nil {
+		newClient = newPahoClient
+	}
+
+	client := newClient(&clientOptions{server: url, clientId: fmt.Sprintf("mqtt-bridgeify-replay-%d", os.Getpid())})
+
+	if err := client.connect(); err != nil {
+		c.Ui.Error(fmt.Sprintf("Unable to connect to %s %s", logRedactor.redact(url), err))
+		return exitFailed
+	}
+
+	defer client.disconnect()
+
+	opts := replayOptions{speed: speed, direction: direction, rewritten: rewritten}
+	total := 0
+
+	for _, name := range files {
+		count, err := c.replayFile(client, name, opts)
+		total += count
+
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to replay %s %s", name, err))
+			return exitFailed
+		}
+	}
+
+	c.Ui.Output(fmt.Sprintf("replayed %d messages", total))
+
+	return exitOk
+}
+
+func (c *ReplayCommand) replayFile(client mqttClient, name string, opts replayOptions) (int, error) {
+
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	return replayCapture(client, file, opts, time.Sleep)
+}
+
+func (c *ReplayCommand) Help() string {
+	helpText := `
+Usage: mqtt-bridgeify replay [options] <file>...
+
+  Publishes the messages in capture files written with the agent's -capture,
+  in order and as far apart as they were captured. Rotated captures are
+  replayed oldest first when given as file.2 file.1 file.
+
+Options:
+
+  -url=tcp://localhost:1883           URL for the broker to publish to.
+  -speed=1                            Multiple of the captured speed, 0 doesn't wait.
+  -direction=local                    Only replay messages from local or cloud.
+  -rewritten                          Publish on the topics the bridge rewrote
+                                      the messages to.
+`
+	return helpText
+}
+
+func (c *ReplayCommand) Synopsis() string {
+	return "Replays captured messages to a broker"
+}
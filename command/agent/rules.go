@@ -0,0 +1,291 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/juju/loggo"
+)
+
+var rulesLog = loggo.GetLogger("rules")
+
+// The topic mappings for both directions.
+type ruleSet struct {
+	local []replaceTopic
+	cloud []replaceTopic
+
+	localDedup *deduper
+	cloudDedup *deduper
+}
+
+// On disk layout of a rules file, this replaces the built in mappings.
+type rulesConfig struct {
+	Local []ruleConfig `json:"local"`
+	Cloud []ruleConfig `json:"cloud"`
+
+	Dedup *dedupConfig `json:"dedup,omitempty"`
+
+	// what to do about rules which match the same messages, see overlapWarn
+	Overlaps string `json:"overlaps,omitempty"`
+}
+
+// Duplicate suppression applies to every rule in a direction.
+type dedupConfig struct {
+	Local *deduper `json:"local,omitempty"`
+	Cloud *deduper `json:"cloud,omitempty"`
+}
+
+type ruleConfig struct {
+	On        string           `json:"on"`
+	Replace   string           `json:"replace"`
+	With      string           `json:"with"`
+	Match     string           `json:"match,omitempty"`
+	To        string           `json:"to,omitempty"`
+	Filters   []*payloadFilter `json:"filters,omitempty"`
+	RateLimit *rateLimiter     `json:"rateLimit,omitempty"`
+	Sample    *sampler         `json:"sample,omitempty"`
+
+	Compress    string `json:"compress,omitempty"`
+	CompressMin int    `json:"compressMin,omitempty"`
+
+	Batch   *batcher `json:"batch,omitempty"`
+	Unbatch bool     `json:"unbatch,omitempty"`
+
+	Encrypt bool `json:"encrypt,omitempty"`
+
+	Share string `json:"share,omitempty"`
+
+	// rules with a higher priority are tried first
+	Priority int `json:"priority,omitempty"`
+}
+
+const (
+	// log ambiguous overlaps
+	overlapWarn = "warn"
+	// refuse to load rules with ambiguous overlaps
+	overlapFail = "fail"
+)
+
+// The serial number is substituted for {serial} in rewrite templates.
+func loadRules(path string, serial string) (*ruleSet, error) {
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	conf := &rulesConfig{}
+
+	if err := json.NewDecoder(file).Decode(conf); err != nil {
+		return nil, fmt.Errorf("unable to parse rules %s: %s", path, err)
+	}
+
+	return conf.compile(serial)
+}
+
+func (c *rulesConfig) compile(serial string) (rules *ruleSet, err error) {
+
+	rules = &ruleSet{}
+
+	if c.Overlaps != "" && c.Overlaps != overlapWarn && c.Overlaps != overlapFail {
+		return nil, fmt.Errorf("overlaps must be %s or %s", overlapWarn, overlapFail)
+	}
+
+	if rules.local, err = compileRules(c.Local, "local", serial); err != nil {
+		return nil, err
+	}
+
+	if rules.local, err = orderRules(rules.local, "local", c.Overlaps == overlapFail); err != nil {
+		return nil, err
+	}
+
+	if rules.cloud, err = compileRules(c.Cloud, "cloud", serial); err != nil {
+		return nil, err
+	}
+
+	if rules.cloud, err = orderRules(rules.cloud, "cloud", c.Overlaps == overlapFail); err != nil {
+		return nil, err
+	}
+
+	if c.Dedup != nil {
+		if rules.localDedup, err = compileDedup(c.Dedup.Local, "local"); err != nil {
+			return nil, err
+		}
+		if rules.cloudDedup, err = compileDedup(c.Dedup.Cloud, "cloud"); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+func compileRules(configs []ruleConfig, tag string, serial string) ([]replaceTopic, error) {
+
+	topics := []replaceTopic{}
+
+	for i, conf := range configs {
+
+		on, levels, err := parseNamedFilter(conf.On)
+
+		if err != nil {
+			return nil, fmt.Errorf("(%s) rule %d: %s: %s", tag, i, conf.On, err)
+		}
+
+		if _, err := mqtt.NewTopicFilter(on, 0); err != nil {
+			return nil, fmt.Errorf("(%s) rule %d: bad topic filter %q: %s", tag, i, conf.On, err)
+		}
+
+		if conf.Match != "" && conf.To == "" {
+			return nil, fmt.Errorf("(%s) rule %d: %s: match needs a to template", tag, i, conf.On)
+		}
+
+		if conf.Replace == "" && conf.To == "" && !conf.Unbatch {
+			return nil, fmt.Errorf("(%s) rule %d: %s has nothing to replace", tag, i, conf.On)
+		}
+
+		if conf.Replace != "" && conf.To != "" {
+			return nil, fmt.Errorf("(%s) rule %d: %s: use either replace and with or to", tag, i, conf.On)
+		}
+
+		var rewrite *topicRewrite
+
+		if conf.To != "" {
+			if rewrite, err = compileRewrite(levels, conf.Match, conf.To, serial); err != nil {
+				return nil, fmt.Errorf("(%s) rule %d: %s: %s", tag, i, conf.On, err)
+			}
+		}
+
+		if conf.Batch != nil {
+			if tag != "local" {
+				return nil, fmt.Errorf("(%s) rule %d: %s: only local rules can batch", tag, i, conf.On)
+			}
+			if err := conf.Batch.compile(); err != nil {
+				return nil, fmt.Errorf("(%s) rule %d: %s: %s", tag, i, conf.On, err)
+			}
+		}
+
+		if conf.Unbatch && tag != "cloud" {
+			return nil, fmt.Errorf("(%s) rule %d: %s: only cloud rules can unbatch", tag, i, conf.On)
+		}
+
+		for _, filter := range conf.Filters {
+			if err := filter.compile(); err != nil {
+				return nil, fmt.Errorf("(%s) rule %d: %s: %s", tag, i, conf.On, err)
+			}
+		}
+
+		if conf.RateLimit != nil {
+			if err := conf.RateLimit.compile(); err != nil {
+				return nil, fmt.Errorf("(%s) rule %d: %s: %s", tag, i, conf.On, err)
+			}
+		}
+
+		if conf.Sample != nil {
+			if err := conf.Sample.compile(); err != nil {
+				return nil, fmt.Errorf("(%s) rule %d: %s: %s", tag, i, conf.On, err)
+			}
+		}
+
+		if conf.Share != "" {
+			if tag != "cloud" {
+				return nil, fmt.Errorf("(%s) rule %d: %s: only cloud rules can share subscriptions", tag, i, conf.On)
+			}
+			if strings.ContainsAny(conf.Share, "/+#") {
+				return nil, fmt.Errorf("(%s) rule %d: %s: bad share group %q", tag, i, conf.On, conf.Share)
+			}
+		}
+
+		if conf.Compress != "" {
+			if err := validCompression(conf.Compress); err != nil {
+				return nil, fmt.Errorf("(%s) rule %d: %s: %s", tag, i, conf.On, err)
+			}
+		}
+
+		topics = append(topics, replaceTopic{
+			on:      on,
+			replace: conf.Replace,
+			with:    conf.With,
+			rewrite: rewrite,
+			filters: conf.Filters,
+			limiter: conf.RateLimit,
+			sampler: conf.Sample,
+
+			compress:    conf.Compress,
+			compressMin: conf.CompressMin,
+
+			batch:   conf.Batch,
+			unbatch: conf.Unbatch,
+
+			encrypt: conf.Encrypt,
+
+			share:    conf.Share,
+			priority: conf.Priority,
+		})
+	}
+
+	return topics, nil
+}
+
+func compileDedup(dedup *deduper, tag string) (*deduper, error) {
+
+	if dedup == nil {
+		return nil, nil
+	}
+
+	if err := dedup.compile(); err != nil {
+		return nil, fmt.Errorf("(%s) %s", tag, err)
+	}
+
+	return dedup, nil
+}
+
+//
+// Sorts the rules into the order messages are matched against them, the first
+// match handles a message. Higher priorities come first, then more specific filters,
+// then the order in the file. Rules of the same priority whose filters overlap
+// without one covering the other are ambiguous, as are duplicate filters, these
+// are logged or, when fail is set, refused.
+//
+func orderRules(topics []replaceTopic, tag string, fail bool) ([]replaceTopic, error) {
+
+	for i, a := range topics {
+		for j := i + 1; j < len(topics); j++ {
+			b := topics[j]
+			if a.priority != b.priority || !overlapFilters(a.on, b.on) {
+				continue
+			}
+			if a.on != b.on && (coversFilter(a.on, b.on) || coversFilter(b.on, a.on)) {
+				continue
+			}
+			err := fmt.Errorf("(%s) rule %d: %s overlaps rule %d: %s", tag, i, a.on, j, b.on)
+			if fail {
+				return nil, err
+			}
+			rulesLog.Warningf("%s", err)
+		}
+	}
+
+	ordered := make([]replaceTopic, len(topics))
+	copy(ordered, topics)
+	sort.Stable(byPrecedence(ordered))
+
+	return ordered, nil
+}
+
+type byPrecedence []replaceTopic
+
+func (p byPrecedence) Len() int      { return len(p) }
+func (p byPrecedence) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPrecedence) Less(i, j int) bool {
+	if p[i].priority != p[j].priority {
+		return p[i].priority > p[j].priority
+	}
+	return moreSpecific(p[i].on, p[j].on)
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/mitchellh/cli"
+)
+
+// RulesCommand prints the effective topic rules and tries messages against
+// them, without connecting to a broker.
+type RulesCommand struct {
+	Ui cli.Ui
+}
+
+func (c *RulesCommand) Run(args []string) int {
+
+	var rulesPath, serial string
+
+	cmdFlags := flag.NewFlagSet("rules", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&rulesPath, "rules", "", "JSON file replacing the built in topic rules")
+	cmdFlags.StringVar(&serial, "serial", "unknown", "the serial number of the device")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return exitFailed
+	}
+
+	conf := &Config{SerialNo: serial}
+
+	if rulesPath != "" {
+		rules, err := loadRules(rulesPath, serial)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Unable to load rules %s", err))
+			return exitFailed
+		}
+		conf.rules = rules
+	}
+
+	bridge := createBridge(conf)
+
+	args = cmdFlags.Args()
+
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		c.list(bridge)
+		return exitOk
+	case len(args) >= 3 && len(args) <= 4 && args[0] == "test" && (args[1] == "local" || args[1] == "cloud"):
+		payload := "{}"
+		if len(args) == 4 {
+			payload = args[3]
+		}
+		return c.test(bridge, args[1], args[2], []byte(payload))
+	}
+
+	c.Ui.Error(c.Help())
+	return exitFailed
+}
+
+func (c *RulesCommand) list(bridge *Bridge) {
+
+	for _, tag := range []string{"local", "cloud"} {
+		c.Ui.Output(fmt.Sprintf("%s:", tag))
+		for i, rule := range bridge.rules(tag) {
+			c.Ui.Output(fmt.Sprintf("  %2d %s", i, rule.describe()))
+		}
+		if dedup := bridge.dedup(tag); dedup != nil {
+			c.Ui.Output(fmt.Sprintf("  dedup window=%dms size=%d field=%s", dedup.Window, dedup.Size, dedup.Field))
+		}
+	}
+}
+
+func (c *RulesCommand) test(bridge *Bridge, tag string, topic string, payload []byte) int {
+
+	result := bridge.trace(tag, topic, payload)
+
+	if !result.Matched {
+		c.Ui.Output(fmt.Sprintf("(%s) %s matches no rule, it is not forwarded", tag, topic))
+		return exitFailed
+	}
+
+	c.Ui.Output(fmt.Sprintf("rule:    %d %s", result.Index, result.Rule.describe()))
+
+	switch {
+	case result.Rule.unbatch:
+		c.Ui.Output("result:  unpacked as a batch envelope")
+	case result.Filtered:
+		c.Ui.Output("result:  dropped by the rule's filters")
+	case result.Topic == "":
+		c.Ui.Output("result:  dropped, the rule's regex doesn't match")
+	default:
+		c.Ui.Output("topic:   " + result.Topic)
+		c.Ui.Output("payload: " + string(result.Payload))
+		if !result.Tagged {
+			c.Ui.Output("source:  already tagged, left as is")
+		}
+		if result.Loop != "" {
+			c.Ui.Output("loop:    " + result.Loop)
+		}
+	}
+
+	return exitOk
+}
+
+func (c *RulesCommand) Help() string {
+	helpText := `
+Usage: mqtt-bridgeify rules [options] list
+       mqtt-bridgeify rules [options] test <local|cloud> <topic> [payload]
+
+  Lists the effective topic rules, or shows what the bridge would do with a
+  message received on topic from the local or cloud broker.
+
+Options:
+
+  -rules=/path/to/rules.json          Use these rules instead of the built in ones.
+  -serial=1234                        Serial number used in templates and tags.
+`
+	return helpText
+}
+
+func (c *RulesCommand) Synopsis() string {
+	return "Inspects and tests the topic rules"
+}
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadRulesSuite struct {
+	dir string
+}
+
+var _ = Suite(&LoadRulesSuite{})
+
+func (s *LoadRulesSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *LoadRulesSuite) write(c *C, rules string) string {
+	path := filepath.Join(s.dir, "rules.json")
+	c.Assert(ioutil.WriteFile(path, []byte(rules), 0600), IsNil)
+	return path
+}
+
+func (s *LoadRulesSuite) TestLoad(c *C) {
+
+	rules, err := loadRules(s.write(c, `{
+		"local": [
+			{"on": "$device/+/channel/+", "replace": "$device", "with": "$cloud/device",
+			 "filters": [{"field": "method", "matches": "^(set|notify)$"}]}
+		],
+		"cloud": [
+			{"on": "$cloud/device/+/channel/+/reply", "replace": "$cloud/device", "with": "$device"}
+		]
+	}`), "")
+
+	c.Assert(err, IsNil)
+	c.Assert(rules.local, HasLen, 1)
+	c.Assert(rules.cloud, HasLen, 1)
+	c.Assert(rules.local[0].filters, HasLen, 1)
+	c.Assert(rules.local[0].updated("$device/a/channel/b"), Equals, "$cloud/device/a/channel/b")
+	c.Assert(rules.cloud[0].updated("$cloud/device/a/channel/b/reply"), Equals, "$device/a/channel/b/reply")
+
+	bridge := createBridge(&Config{rules: rules})
+	c.Assert(bridge.localTopics, DeepEquals, rules.local)
+}
+
+func (s *LoadRulesSuite) TestRewrite(c *C) {
+
+	rules, err := loadRules(s.write(c, `{
+		"local": [
+			{"on": "$device/{id}/channel/{ch}", "to": "$cloud/sphere/{serial}/device/{id}/{ch}"},
+			{"on": "$node/#", "match": "\\$node/([^/]+)/module/status", "to": "$cloud/sphere/{serial}/node/{1}"}
+		]
+	}`), "1234")
+
+	c.Assert(err, IsNil)
+	c.Assert(rules.local[0].on, Equals, "$device/+/channel/+")
+	c.Assert(rules.local[0].updated("$device/a/channel/b"), Equals, "$cloud/sphere/1234/device/a/b")
+	c.Assert(rules.local[1].updated("$node/n1/module/status"), Equals, "$cloud/sphere/1234/node/n1")
+	c.Assert(rules.local[1].updated("$node/n1/module/other"), Equals, "")
+}
+
+func (s *LoadRulesSuite) TestPrecedence(c *C) {
+
+	rules, err := loadRules(s.write(c, `{
+		"cloud": [
+			{"on": "$cloud/device/#", "replace": "$cloud/device", "with": "$device"},
+			{"on": "$cloud/device/+/channel/+/reply", "replace": "$cloud/device", "with": "$device"},
+			{"on": "$cloud/device/+/+/location", "replace": "$cloud", "with": "", "priority": 1},
+			{"on": "$cloud/device/+/channel/+", "replace": "$cloud/device", "with": "$device"}
+		]
+	}`), "")
+
+	c.Assert(err, IsNil)
+
+	order := []string{}
+	for _, rule := range rules.cloud {
+		order = append(order, rule.on)
+	}
+
+	c.Assert(order, DeepEquals, []string{
+		"$cloud/device/+/+/location",
+		"$cloud/device/+/channel/+/reply",
+		"$cloud/device/+/channel/+",
+		"$cloud/device/#",
+	})
+}
+
+func (s *LoadRulesSuite) TestAmbiguous(c *C) {
+
+	ambiguous := `{"overlaps": "%s", "local": [
+		{"on": "$device/+/channel/state", "replace": "$device", "with": "$cloud/device"},
+		{"on": "$device/a/channel/+", "replace": "$device", "with": "$cloud/device"}
+	]}`
+
+	rules, err := loadRules(s.write(c, fmt.Sprintf(ambiguous, "warn")), "")
+	c.Assert(err, IsNil)
+	c.Assert(rules.local, HasLen, 2)
+
+	_, err = loadRules(s.write(c, fmt.Sprintf(ambiguous, "fail")), "")
+	c.Assert(err, ErrorMatches, `\(local\) rule 0: .* overlaps rule 1: .*`)
+
+	_, err = loadRules(s.write(c, fmt.Sprintf(ambiguous, "sometimes")), "")
+	c.Assert(err, ErrorMatches, "overlaps must be .*")
+
+	// a priority settles it
+	_, err = loadRules(s.write(c, `{"overlaps": "fail", "local": [
+		{"on": "$device/+/channel/state", "replace": "$device", "with": "$cloud/device"},
+		{"on": "$device/a/channel/+", "replace": "$device", "with": "$cloud/device", "priority": 1}
+	]}`), "")
+	c.Assert(err, IsNil)
+}
+
+func (s *LoadRulesSuite) TestInvalid(c *C) {
+
+	_, err := loadRules(filepath.Join(s.dir, "missing.json"), "")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = loadRules(s.write(c, `{"local": [`), "")
+	c.Assert(err, ErrorMatches, "unable to parse rules .*")
+
+	_, err = loadRules(s.write(c, `{"local": [{"on": "$device/#/x", "replace": "$device", "with": "$cloud/device"}]}`), "")
+	c.Assert(err, ErrorMatches, `\(local\) rule 0: bad topic filter .*`)
+
+	_, err = loadRules(s.write(c, `{"cloud": [{"on": "$cloud/device/+", "with": "$device"}]}`), "")
+	c.Assert(err, ErrorMatches, `\(cloud\) rule 0: .* has nothing to replace`)
+
+	_, err = loadRules(s.write(c, `{"local": [{"on": "$device/+", "replace": "$device", "with": "$cloud/device", "filters": [{"field": "x", "matches": "("}]}]}`), "")
+	c.Assert(err, ErrorMatches, `\(local\) rule 0: .* bad regex .*`)
+
+	_, err = loadRules(s.write(c, `{"cloud": [{"on": "$cloud/device/+", "replace": "$cloud", "with": "", "batch": {"topic": "x", "delay": 10}}]}`), "")
+	c.Assert(err, ErrorMatches, `\(cloud\) rule 0: .* only local rules can batch`)
+
+	_, err = loadRules(s.write(c, `{"local": [{"on": "$device/batch", "unbatch": true}]}`), "")
+	c.Assert(err, ErrorMatches, `\(local\) rule 0: .* only cloud rules can unbatch`)
+
+	_, err = loadRules(s.write(c, `{"local": [{"on": "$device/{id}", "replace": "$device", "to": "$cloud/{id}"}]}`), "")
+	c.Assert(err, ErrorMatches, `\(local\) rule 0: .* use either replace and with or to`)
+
+	_, err = loadRules(s.write(c, `{"local": [{"on": "$device/#", "replace": "$device", "with": "$cloud/device", "share": "bridges"}]}`), "")
+	c.Assert(err, ErrorMatches, `\(local\) rule 0: .* only cloud rules can share subscriptions`)
+
+	_, err = loadRules(s.write(c, `{"cloud": [{"on": "$cloud/#", "replace": "$cloud", "with": "", "share": "a/b"}]}`), "")
+	c.Assert(err, ErrorMatches, `\(cloud\) rule 0: .* bad share group .*`)
+
+	_, err = loadRules(s.write(c, `{"local": [{"on": "$device/+", "match": "x"}]}`), "")
+	c.Assert(err, ErrorMatches, `\(local\) rule 0: .* match needs a to template`)
+
+	_, err = loadRules(s.write(c, `{"local": [{"on": "$device/{id}", "to": "$cloud/{ch}"}]}`), "")
+	c.Assert(err, ErrorMatches, `\(local\) rule 0: .* uses unknown \{ch\}`)
+}
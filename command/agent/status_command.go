@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+// StatusCommand asks a running agent for its status over the local broker.
+type StatusCommand struct {
+	Ui cli.Ui
+}
+
+func (c *StatusCommand) Run(args []string) int {
+
+	var localUrl string
+	var asJson bool
+	var timeout int
+
+	cmdFlags := flag.NewFlagSet("status", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&localUrl, "localurl", "tcp://localhost:1883", "URL for the local broker")
+	cmdFlags.BoolVar(&asJson, "json", false, "print the raw JSON status")
+	cmdFlags.IntVar(&timeout, "timeout", 5, "seconds to wait for the agent")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return exitFailed
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
+	query, _ := json.Marshal(&statusQuery{Id: id})
+
+	reply, err := busRequest(localUrl, statusQueryTopic, statusReplyTopic, id, query, time.Duration(timeout)*time.Second)
+
+	if err == ErrNoAnswer {
+		c.Ui.Error(fmt.Sprintf("No answer from the agent within %ds, is it running?", timeout))
+		return exitTimeout
+	}
+
+	if err == ErrConnectTimeout {
+		c.Ui.Error(fmt.Sprintf("The broker at %s didn't accept the connection within %ds", logRedactor.redact(localUrl), timeout))
+		return exitTimeout
+	}
+
+	if err != nil {
+		c.Ui.Error(logRedactor.redactError(err))
+		return exitFailed
+	}
+
+	if asJson {
+		out := &bytes.Buffer{}
+		json.Indent(out, reply, "", "  ")
+		c.Ui.Output(out.String())
+		return exitOk
+	}
+
+	report := &statusReport{}
+
+	if err := json.Unmarshal(reply, report); err != nil {
+		c.Ui.Error(fmt.Sprintf("Unable to decode status %s", err))
+		return exitFailed
+	}
+
+	c.Ui.Output(formatReport(report))
+
+	return exitOk
+}
+
+func formatReport(r *statusReport) string {
+
+	out := &bytes.Buffer{}
+
+	state := func(connected bool) string {
+		if connected {
+			return "connected"
+		}
+		return "disconnected"
+	}
+
+	configured := "not configured"
+	if r.Configured {
+		configured = "configured"
+	}
+
+	fmt.Fprintf(out, "bridge:      %s, %s\n", state(r.Connected), configured)
+	fmt.Fprintf(out, "local:       %s\n", state(r.LocalConnected))
+	fmt.Fprintf(out, "cloud:       %s %s\n", state(r.CloudConnected), r.Endpoint)
+	if r.CredentialsRequired {
+		fmt.Fprintf(out, "credentials: required\n")
+	}
+	fmt.Fprintf(out, "last error:  %s\n", r.LastError)
+	fmt.Fprintf(out, "updated:     %s\n", time.Unix(r.Timestamp, 0).Format(time.RFC3339))
+
+	fmt.Fprintf(out, "\ncounters:\n")
+	counters := []struct {
+		name  string
+		value int64
+	}{
+		{"ingress", r.IngressCounter},
+		{"ingress bytes", r.IngressBytes},
+		{"egress", r.EgressCounter},
+		{"egress bytes", r.EgressBytes},
+		{"filtered", r.FilteredCounter},
+		{"duplicates", r.DuplicateCounter},
+		{"rate limited", r.RateLimitedCounter},
+		{"sampled", r.SampledCounter},
+		{"batches", r.BatchCounter},
+		{"unbatched", r.UnbatchCounter},
+		{"encrypt failures", r.EncryptFailures},
+		{"decrypt failures", r.DecryptFailures},
+		{"rejected requests", r.RejectedCounter},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(out, "  %-18s %d\n", counter.name, counter.value)
+	}
+	if r.CompressedRawBytes > 0 {
+		fmt.Fprintf(out, "  %-18s %.2f\n", "compression ratio", r.CompressionRatio)
+	}
+	if r.ProbeSent > 0 {
+		fmt.Fprintf(out, "  %-18s %d sent, %d lost\n", "probes", r.ProbeSent, r.ProbeLost)
+		fmt.Fprintf(out, "  %-18s p50 %.1fms p90 %.1fms p99 %.1fms\n", "round trip", r.ProbeLatencyP50, r.ProbeLatencyP90, r.ProbeLatencyP99)
+	}
+
+	for _, rules := range []struct {
+		tag   string
+		stats []ruleStat
+	}{{"local", r.LocalRules}, {"cloud", r.CloudRules}} {
+		fmt.Fprintf(out, "\n%s rules:\n", rules.tag)
+		for _, stat := range rules.stats {
+			fmt.Fprintf(out, "  %8d %s\n", stat.Forwarded, stat.On)
+		}
+	}
+
+	return strings.TrimRight(out.String(), "\n")
+}
+
+func (c *StatusCommand) Help() string {
+	helpText := `
+Usage: mqtt-bridgeify status [options]
+
+  Asks the agent running against the local broker for its status.
+  Exits with 2 if it doesn't answer.
+
+Options:
+
+  -localurl=tcp://localhost:1883      URL for the local broker.
+  -json                               Print the status as JSON.
+  -timeout=5                          Seconds to wait for the agent to answer.
+`
+	return helpText
+}
+
+func (c *StatusCommand) Synopsis() string {
+	return "Shows the status of a running agent"
+}
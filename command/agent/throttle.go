@@ -0,0 +1,279 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	sampleLatest = "latest"
+	sampleNth    = "nth"
+	sampleChange = "change"
+)
+
+// Every device has topics of its own, so the per topic state is swept for idle
+// topics at most this often to keep it from growing without bound.
+const throttleSweep = time.Minute
+
+// how long a topic's sampling state is kept once messages stop arriving on it
+const sampleIdle = 10 * time.Minute
+
+//
+// Token bucket per concrete topic, each topic may burst up to Burst messages
+// then is held to Rate messages per second.
+//
+type rateLimiter struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst,omitempty"`
+
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	lock    sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (r *rateLimiter) compile() error {
+
+	if r.Rate <= 0 {
+		return fmt.Errorf("rate limit must be greater than zero")
+	}
+
+	if r.Burst < 1 {
+		r.Burst = 1
+	}
+
+	r.buckets = make(map[string]*tokenBucket)
+
+	return nil
+}
+
+func (r *rateLimiter) allow(topic string, now time.Time) bool {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if now.Sub(r.swept) >= throttleSweep {
+		r.sweep(now)
+	}
+
+	bucket, ok := r.buckets[topic]
+
+	if !ok {
+		bucket = &tokenBucket{tokens: r.Burst, last: now}
+		r.buckets[topic] = bucket
+	}
+
+	bucket.tokens = math.Min(r.Burst, bucket.tokens+now.Sub(bucket.last).Seconds()*r.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// Forgets the buckets which have had time to fill up again, a new bucket starts
+// out full so nothing changes for those topics.
+func (r *rateLimiter) sweep(now time.Time) {
+
+	refill := time.Duration(r.Burst / r.Rate * float64(time.Second))
+
+	for topic, bucket := range r.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(r.buckets, topic)
+		}
+	}
+
+	r.swept = now
+}
+
+//
+// Thins out messages per concrete topic using one of the following modes.
+//
+//  latest  forwards at most one message per Interval ms, the last one received
+//          in an interval wins and is sent when the interval ends.
+//  nth     forwards the first and then every Every'th message.
+//  change  forwards only when the payload changes, or when Field is set when that
+//          numeric field moves by more than Deadband from the last value sent.
+//
+type sampler struct {
+	Mode     string  `json:"mode"`
+	Interval int     `json:"interval,omitempty"`
+	Every    int     `json:"every,omitempty"`
+	Field    string  `json:"field,omitempty"`
+	Deadband float64 `json:"deadband,omitempty"`
+
+	topics map[string]*sampleState
+	swept  time.Time
+	lock   sync.Mutex
+}
+
+type sampleState struct {
+	seen     time.Time
+	count    int
+	lastSent time.Time
+	pending  *bridgeMessage
+	timer    *time.Timer
+	previous []byte
+	value    *float64
+}
+
+func (s *sampler) compile() error {
+
+	switch s.Mode {
+	case sampleLatest:
+		if s.Interval <= 0 {
+			return fmt.Errorf("%s sampling needs an interval", s.Mode)
+		}
+	case sampleNth:
+		if s.Every <= 0 {
+			return fmt.Errorf("%s sampling needs every", s.Mode)
+		}
+	case sampleChange:
+		if s.Deadband < 0 {
+			return fmt.Errorf("%s sampling needs a positive deadband", s.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown sampling mode %q", s.Mode)
+	}
+
+	s.topics = make(map[string]*sampleState)
+
+	return nil
+}
+
+// Decides whether a message is forwarded straight away and whether this offer
+// suppressed a message. Messages released later, at the end of an interval, are
+// handed to send.
+func (s *sampler) offer(topic string, msg *bridgeMessage, now time.Time, send func(*bridgeMessage)) (forward bool, suppressed bool) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.swept) >= throttleSweep {
+		s.sweep(now)
+	}
+
+	state, ok := s.topics[topic]
+
+	if !ok {
+		state = &sampleState{}
+		s.topics[topic] = state
+	}
+
+	state.seen = now
+
+	switch s.Mode {
+	case sampleLatest:
+		interval := time.Duration(s.Interval) * time.Millisecond
+
+		if state.timer == nil && now.Sub(state.lastSent) >= interval {
+			state.lastSent = now
+			return true, false
+		}
+
+		suppressed = state.pending != nil
+		state.pending = msg
+
+		if state.timer == nil {
+			state.timer = time.AfterFunc(state.lastSent.Add(interval).Sub(now), func() {
+				s.lock.Lock()
+				pending := state.pending
+				state.pending = nil
+				state.timer = nil
+				state.lastSent = time.Now()
+				s.lock.Unlock()
+
+				if pending != nil {
+					send(pending)
+				}
+			})
+		}
+
+		return false, suppressed
+
+	case sampleNth:
+		forward = state.count%s.Every == 0
+		state.count++
+		return forward, !forward
+
+	case sampleChange:
+		forward = s.changed(state, msg.payload)
+		return forward, !forward
+	}
+
+	return true, false
+}
+
+func (s *sampler) changed(state *sampleState, payload []byte) bool {
+
+	if s.Field == "" {
+		if state.previous != nil && bytes.Equal(state.previous, payload) {
+			return false
+		}
+		state.previous = append([]byte{}, payload...)
+		return true
+	}
+
+	var doc interface{}
+
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		// nothing to compare, let it through
+		return true
+	}
+
+	value, found := lookupField(doc, s.Field)
+	number, ok := value.(float64)
+
+	if !found || !ok {
+		return true
+	}
+
+	if state.value != nil && math.Abs(number-*state.value) <= s.Deadband {
+		return false
+	}
+
+	state.value = &number
+
+	return true
+}
+
+// Forgets topics which have been quiet for sampleIdle, and longer than an interval,
+// unless a message is still held for them. Their next message starts afresh.
+func (s *sampler) sweep(now time.Time) {
+
+	interval := time.Duration(s.Interval) * time.Millisecond
+
+	for topic, state := range s.topics {
+		if state.timer == nil && now.Sub(state.seen) >= sampleIdle && now.Sub(state.lastSent) >= interval {
+			delete(s.topics, topic)
+		}
+	}
+
+	s.swept = now
+}
+
+// Stops any pending interval flushes, the held messages are dropped.
+func (s *sampler) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, state := range s.topics {
+		if state.timer != nil {
+			state.timer.Stop()
+			state.timer = nil
+			state.pending = nil
+		}
+	}
+}
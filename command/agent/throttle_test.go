@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadThrottleSuite struct {
+	now time.Time
+}
+
+var _ = Suite(&LoadThrottleSuite{})
+
+func (s *LoadThrottleSuite) SetUpTest(c *C) {
+	s.now = time.Unix(1412345678, 0)
+}
+
+func message(payload []byte) *bridgeMessage {
+	return &bridgeMessage{topic: "t", payload: payload, size: len(payload)}
+}
+
+func (s *LoadThrottleSuite) TestRateLimit(c *C) {
+
+	limiter := &rateLimiter{Rate: 2, Burst: 3}
+	c.Assert(limiter.compile(), IsNil)
+
+	// the burst goes straight through
+	for i := 0; i < 3; i++ {
+		c.Assert(limiter.allow("$device/a/b/rssi", s.now), Equals, true)
+	}
+	c.Assert(limiter.allow("$device/a/b/rssi", s.now), Equals, false)
+
+	// other topics have their own bucket
+	c.Assert(limiter.allow("$device/c/d/rssi", s.now), Equals, true)
+
+	// half a second buys one more at 2/s
+	c.Assert(limiter.allow("$device/a/b/rssi", s.now.Add(500*time.Millisecond)), Equals, true)
+	c.Assert(limiter.allow("$device/a/b/rssi", s.now.Add(500*time.Millisecond)), Equals, false)
+
+	c.Assert((&rateLimiter{}).compile(), NotNil)
+}
+
+func (s *LoadThrottleSuite) TestForgetIdleTopics(c *C) {
+
+	limiter := &rateLimiter{Rate: 1, Burst: 2}
+	c.Assert(limiter.compile(), IsNil)
+
+	limiter.allow("$device/a/b/rssi", s.now)
+	limiter.allow("$device/a/b/rssi", s.now)
+	limiter.allow("$device/c/d/rssi", s.now)
+	c.Assert(limiter.buckets, HasLen, 2)
+
+	// both have refilled by the next sweep
+	limiter.allow("$device/e/f/rssi", s.now.Add(throttleSweep))
+	c.Assert(limiter.buckets, HasLen, 1)
+
+	sample := &sampler{Mode: sampleChange}
+	c.Assert(sample.compile(), IsNil)
+
+	sample.offer("$device/a/b/rssi", message([]byte("1")), s.now, nil)
+	sample.offer("$device/c/d/rssi", message([]byte("1")), s.now.Add(sampleIdle/2), nil)
+
+	// only the first has been quiet long enough
+	later := s.now.Add(sampleIdle)
+	forward, _ := sample.offer("$device/c/d/rssi", message([]byte("1")), later, nil)
+	c.Assert(forward, Equals, false)
+	c.Assert(sample.topics, HasLen, 1)
+
+	// and is treated as new
+	forward, _ = sample.offer("$device/a/b/rssi", message([]byte("1")), later, nil)
+	c.Assert(forward, Equals, true)
+}
+
+func (s *LoadThrottleSuite) TestSampleNth(c *C) {
+
+	sample := &sampler{Mode: sampleNth, Every: 3}
+	c.Assert(sample.compile(), IsNil)
+
+	forwarded := []bool{}
+	for i := 0; i < 7; i++ {
+		forward, suppressed := sample.offer("t", message([]byte("{}")), s.now, nil)
+		c.Assert(suppressed, Equals, !forward)
+		forwarded = append(forwarded, forward)
+	}
+
+	c.Assert(forwarded, DeepEquals, []bool{true, false, false, true, false, false, true})
+}
+
+func (s *LoadThrottleSuite) TestSampleChange(c *C) {
+
+	sample := &sampler{Mode: sampleChange}
+	c.Assert(sample.compile(), IsNil)
+
+	offer := func(payload string) bool {
+		forward, _ := sample.offer("t", message([]byte(payload)), s.now, nil)
+		return forward
+	}
+
+	c.Assert(offer(`{"on":true}`), Equals, true)
+	c.Assert(offer(`{"on":true}`), Equals, false)
+	c.Assert(offer(`{"on":false}`), Equals, true)
+}
+
+func (s *LoadThrottleSuite) TestSampleDeadband(c *C) {
+
+	sample := &sampler{Mode: sampleChange, Field: "params.0", Deadband: 3}
+	c.Assert(sample.compile(), IsNil)
+
+	offer := func(payload string) bool {
+		forward, _ := sample.offer("t", message([]byte(payload)), s.now, nil)
+		return forward
+	}
+
+	c.Assert(offer(`{"params":[-70]}`), Equals, true)
+	c.Assert(offer(`{"params":[-72]}`), Equals, false)
+	c.Assert(offer(`{"params":[-73]}`), Equals, false)
+	c.Assert(offer(`{"params":[-74]}`), Equals, true)
+	c.Assert(offer(`{"params":[-71]}`), Equals, false)
+	c.Assert(offer(`not json`), Equals, true)
+}
+
+func (s *LoadThrottleSuite) TestSampleLatest(c *C) {
+
+	sample := &sampler{Mode: sampleLatest, Interval: 50}
+	c.Assert(sample.compile(), IsNil)
+
+	sent := make(chan string, 5)
+	send := func(msg *bridgeMessage) {
+		sent <- string(msg.payload)
+	}
+
+	offer := func(payload string) (bool, bool) {
+		return sample.offer("t", message([]byte(payload)), time.Now(), send)
+	}
+
+	forward, suppressed := offer("1")
+	c.Assert(forward, Equals, true)
+	c.Assert(suppressed, Equals, false)
+
+	forward, suppressed = offer("2")
+	c.Assert(forward, Equals, false)
+	c.Assert(suppressed, Equals, false)
+
+	// replaces the held message
+	forward, suppressed = offer("3")
+	c.Assert(forward, Equals, false)
+	c.Assert(suppressed, Equals, true)
+
+	select {
+	case payload := <-sent:
+		c.Assert(payload, Equals, "3")
+	case <-time.After(time.Second):
+		c.Fatal("held message was never sent")
+	}
+
+	c.Assert(len(sent), Equals, 0)
+}
+
+func (s *LoadThrottleSuite) TestSampleCompile(c *C) {
+	c.Assert((&sampler{Mode: "sometimes"}).compile(), NotNil)
+	c.Assert((&sampler{Mode: sampleLatest}).compile(), NotNil)
+	c.Assert((&sampler{Mode: sampleNth}).compile(), NotNil)
+	c.Assert((&sampler{Mode: sampleChange, Deadband: -1}).compile(), NotNil)
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const tokenCommandTimeout = 30 * time.Second
+
+var ErrEmptyToken = errors.New("Token command returned an empty token")
+
+type credentialsEvent struct {
+	Url       string `json:"url"`
+	LastError string `json:"lastError"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Runs the configured token provider and returns the first line it prints as the
+// new token. The cloud url is passed in the environment so a single provider can
+// serve several clouds.
+func runTokenCommand(command string, cloudUrl string, timeout time.Duration) (string, error) {
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "MQTT_BRIDGEIFY_URL="+cloudUrl)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// its own process group, so a timeout also kills anything the shell started
+	// which would otherwise keep stdout open and Wait blocked
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	timer := time.AfterFunc(timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	defer timer.Stop()
+
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("%s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	token := strings.TrimSpace(strings.SplitN(stdout.String(), "\n", 2)[0])
+
+	if token == "" {
+		return "", ErrEmptyToken
+	}
+
+	return token, nil
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type LoadTokenSuite struct{}
+
+var _ = Suite(&LoadTokenSuite{})
+
+func (s *LoadTokenSuite) TestTokenCommand(c *C) {
+
+	token, err := runTokenCommand(`printf "abc123\nignored\n"`, "ssl://dev.ninjasphere.co:8883", time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "abc123")
+
+	token, err = runTokenCommand(`echo $MQTT_BRIDGEIFY_URL`, "ssl://dev.ninjasphere.co:8883", time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "ssl://dev.ninjasphere.co:8883")
+}
+
+func (s *LoadTokenSuite) TestTokenCommandFailure(c *C) {
+
+	_, err := runTokenCommand("exit 1", "", time.Second)
+	c.Assert(err, NotNil)
+
+	_, err = runTokenCommand("true", "", time.Second)
+	c.Assert(err, Equals, ErrEmptyToken)
+
+	_, err = runTokenCommand("exec sleep 5", "", 100*time.Millisecond)
+	c.Assert(err, NotNil)
+
+	// the shell waits on sleep, which holds stdout open after the shell is killed
+	started := time.Now()
+	_, err = runTokenCommand("sleep 5; echo too-late", "", 100*time.Millisecond)
+	c.Assert(err, NotNil)
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+}
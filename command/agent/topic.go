@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// {name} placeholders in rewrite templates
+var templateVar = regexp.MustCompile(`\{[^{}/]*\}`)
+
+// Reports whether a topic matches an MQTT topic filter, following the spec in
+// that wildcards at the start of a filter don't match $ topics.
+func matchTopic(filter string, topic string) bool {
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+//
+// Rewrites a topic into a template. Values come either from the levels of the
+// rule's topic filter, where a {name} level matches any single level and # is
+// available as {#}, or from the groups of an anchored regex, as {1} or {name}.
+// {serial} is always the sphere's serial number.
+//
+type topicRewrite struct {
+	levels []string
+	regex  *regexp.Regexp
+	to     string
+	serial string
+}
+
+// Turns a filter with named levels into a plain MQTT topic filter and the names
+// captured at each level.
+func parseNamedFilter(on string) (string, []string, error) {
+
+	levels := strings.Split(on, "/")
+	names := make([]string, len(levels))
+	seen := make(map[string]bool)
+
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			names[i] = "#"
+		case strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}"):
+			name := level[1 : len(level)-1]
+			if name == "" || name == "#" || name == "serial" || seen[name] {
+				return "", nil, fmt.Errorf("bad level name %q", level)
+			}
+			seen[name] = true
+			names[i] = name
+			levels[i] = "+"
+		case strings.ContainsAny(level, "{}"):
+			return "", nil, fmt.Errorf("named level %q must be a whole level", level)
+		}
+	}
+
+	return strings.Join(levels, "/"), names, nil
+}
+
+func compileRewrite(levels []string, match string, to string, serial string) (*topicRewrite, error) {
+
+	rewrite := &topicRewrite{levels: levels, to: to, serial: serial}
+	known := map[string]bool{"serial": true}
+
+	if match != "" {
+		regex, err := regexp.Compile("^(?:" + match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("bad regex %q: %s", match, err)
+		}
+		rewrite.regex = regex
+		for i, name := range regex.SubexpNames() {
+			known[strconv.Itoa(i)] = true
+			known[name] = name != ""
+		}
+	} else {
+		for _, name := range levels {
+			known[name] = name != ""
+		}
+	}
+
+	for _, v := range templateVar.FindAllString(to, -1) {
+		if !known[v[1:len(v)-1]] {
+			return nil, fmt.Errorf("template %q uses unknown %s", to, v)
+		}
+	}
+
+	return rewrite, nil
+}
+
+// Returns the rewritten topic, or false when the topic doesn't match the regex.
+func (t *topicRewrite) apply(topic string) (string, bool) {
+
+	vars := map[string]string{"serial": t.serial}
+
+	if t.regex != nil {
+		groups := t.regex.FindStringSubmatch(topic)
+		if groups == nil {
+			return "", false
+		}
+		for i, name := range t.regex.SubexpNames() {
+			vars[strconv.Itoa(i)] = groups[i]
+			if name != "" {
+				vars[name] = groups[i]
+			}
+		}
+	} else {
+		parts := strings.Split(topic, "/")
+		for i, name := range t.levels {
+			if name == "#" {
+				if i < len(parts) {
+					vars[name] = strings.Join(parts[i:], "/")
+				}
+			} else if name != "" && i < len(parts) {
+				vars[name] = parts[i]
+			}
+		}
+	}
+
+	to := t.to
+
+	if _, ok := vars["#"]; !ok && t.regex == nil {
+		// # matched the parent level, drop the separator too rather than leave a trailing /
+		to = strings.Replace(to, "/{#}", "", -1)
+	}
+
+	return templateVar.ReplaceAllStringFunc(to, func(v string) string {
+		return vars[v[1:len(v)-1]]
+	}), true
+}
+
+const sharePrefix = "$share/"
+
+// Reports whether every topic matching filter also matches other.
+func coversFilter(other string, filter string) bool {
+
+	otherLevels := strings.Split(other, "/")
+	filterLevels := strings.Split(filter, "/")
+
+	// wildcards at the start don't match $ topics
+	if (otherLevels[0] == "+" || otherLevels[0] == "#") && strings.HasPrefix(filterLevels[0], "$") {
+		return false
+	}
+
+	for i, level := range otherLevels {
+		if level == "#" {
+			return i <= len(filterLevels)
+		}
+		if i >= len(filterLevels) || filterLevels[i] == "#" {
+			return false
+		}
+		if level != "+" && level != filterLevels[i] {
+			return false
+		}
+	}
+
+	return len(otherLevels) == len(filterLevels)
+}
+
+// Collects the filters to subscribe to for a set of rules. Filters another filter
+// in the same share group already covers are left out, the broker would otherwise
+// deliver those messages once per subscription.
+func subscriptionFilters(topics []replaceTopic, tag string) []string {
+
+	type subscription struct {
+		share  string
+		filter string
+	}
+
+	all := []subscription{}
+
+	for _, topic := range topics {
+		for _, filter := range topic.subscriptions(tag) {
+			all = append(all, subscription{share: topic.share, filter: filter})
+		}
+	}
+
+	filters := []string{}
+
+	for i, sub := range all {
+		covered := false
+		for j, other := range all {
+			if i == j || other.share != sub.share || !coversFilter(other.filter, sub.filter) {
+				continue
+			}
+			// of two identical filters keep the first
+			if other.filter != sub.filter || j < i {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		if sub.share != "" {
+			filters = append(filters, sharePrefix+sub.share+"/"+sub.filter)
+		} else {
+			filters = append(filters, sub.filter)
+		}
+	}
+
+	return filters
+}
+
+// Reports whether some topic matches both filters.
+func overlapFilters(a string, b string) bool {
+
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+
+	for i := 0; ; i++ {
+		if i == len(aLevels) || i == len(bLevels) {
+			// a # also matches its parent level
+			return len(aLevels) == len(bLevels) ||
+				(i < len(aLevels) && aLevels[i] == "#") ||
+				(i < len(bLevels) && bLevels[i] == "#")
+		}
+		if aLevels[i] == "#" || bLevels[i] == "#" {
+			return true
+		}
+		if aLevels[i] != "+" && bLevels[i] != "+" && aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+}
+
+// Compares how narrow two filters are, more literal levels win, then filters
+// without #, then deeper filters. A filter which covers another is never more
+// specific than it.
+func moreSpecific(a string, b string) bool {
+
+	score := func(filter string) (literals int, hash int, depth int) {
+		levels := strings.Split(filter, "/")
+		for _, level := range levels {
+			switch level {
+			case "#":
+				hash = 1
+			case "+":
+			default:
+				literals++
+			}
+		}
+		return literals, hash, len(levels)
+	}
+
+	aLiterals, aHash, aDepth := score(a)
+	bLiterals, bHash, bDepth := score(b)
+
+	if aLiterals != bLiterals {
+		return aLiterals > bLiterals
+	}
+	if aHash != bHash {
+		return aHash < bHash
+	}
+	return aDepth > bDepth
+}
@@ -0,0 +1,146 @@
+package agent
+
+import . "launchpad.net/gocheck"
+
+type LoadTopicSuite struct{}
+
+var _ = Suite(&LoadTopicSuite{})
+
+func (s *LoadTopicSuite) TestMatchTopic(c *C) {
+
+	matches := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"$device/+/channel/+", "$device/a/channel/b", true},
+		{"$device/+/channel/+", "$device/a/channel/b/reply", false},
+		{"$device/+/channel/+/reply", "$device/a/channel/b", false},
+		{"$device/+/+/rssi", "$device/a/b/rssi", true},
+		{"$location/calibration", "$location/calibration", true},
+		{"$location/calibration", "$location/delete", false},
+		{"$node/#", "$node/a/module/status", true},
+		{"$node/#", "$node", true},
+		{"$node/+", "$node", false},
+		{"#", "$node/a", false},
+		{"+/a", "$node/a", false},
+		{"#", "node/a", true},
+	}
+
+	for _, m := range matches {
+		c.Check(matchTopic(m.filter, m.topic), Equals, m.match, Commentf("%s %s", m.filter, m.topic))
+	}
+}
+
+func (s *LoadTopicSuite) TestTemplateRewrite(c *C) {
+
+	on, levels, err := parseNamedFilter("$device/{id}/channel/{ch}/#")
+	c.Assert(err, IsNil)
+	c.Assert(on, Equals, "$device/+/channel/+/#")
+
+	rewrite, err := compileRewrite(levels, "", "$cloud/sphere/{serial}/device/{id}/{ch}/{#}", "1234")
+	c.Assert(err, IsNil)
+
+	updated, ok := rewrite.apply("$device/a/channel/b/event/state")
+	c.Assert(ok, Equals, true)
+	c.Assert(updated, Equals, "$cloud/sphere/1234/device/a/b/event/state")
+
+	// # also matches the parent level, which leaves nothing to put after the /
+	updated, ok = rewrite.apply("$device/a/channel/b")
+	c.Assert(ok, Equals, true)
+	c.Assert(updated, Equals, "$cloud/sphere/1234/device/a/b")
+
+	for _, bad := range []string{"$device/{}", "$device/{id}/{id}", "$device/x{id}", "$device/{serial}"} {
+		_, _, err = parseNamedFilter(bad)
+		c.Check(err, NotNil, Commentf("%s", bad))
+	}
+
+	_, err = compileRewrite(levels, "", "$cloud/{node}", "")
+	c.Assert(err, ErrorMatches, `template .* uses unknown \{node\}`)
+}
+
+func (s *LoadTopicSuite) TestRegexRewrite(c *C) {
+
+	rewrite, err := compileRewrite(nil, `\$node/(?P<node>[^/]+)/module/([^/]+)`, "$cloud/sphere/{serial}/node/{node}/{2}", "1234")
+	c.Assert(err, IsNil)
+
+	updated, ok := rewrite.apply("$node/n1/module/status")
+	c.Assert(ok, Equals, true)
+	c.Assert(updated, Equals, "$cloud/sphere/1234/node/n1/status")
+
+	// the regex is anchored
+	_, ok = rewrite.apply("$node/n1/module/status/extra")
+	c.Assert(ok, Equals, false)
+
+	_, err = compileRewrite(nil, `\$node/(`, "$cloud/x", "")
+	c.Assert(err, ErrorMatches, "bad regex .*")
+
+	_, err = compileRewrite(nil, `\$node/([^/]+)`, "$cloud/{2}", "")
+	c.Assert(err, ErrorMatches, `template .* uses unknown \{2\}`)
+}
+
+func (s *LoadTopicSuite) TestCoversFilter(c *C) {
+
+	covers := []struct {
+		other  string
+		filter string
+		covers bool
+	}{
+		{"$device/#", "$device/+/+/rssi", true},
+		{"$device/#", "$device", true},
+		{"$device/#", "$device/#", true},
+		{"$device/+/#", "$device", false},
+		{"$device/+/+/rssi", "$device/#", false},
+		{"$device/+/channel/+", "$device/a/channel/b", true},
+		{"$device/a/channel/+", "$device/+/channel/b", false},
+		{"#", "$device/a", false},
+		{"#", "+/a", true},
+	}
+
+	for _, m := range covers {
+		c.Check(coversFilter(m.other, m.filter), Equals, m.covers, Commentf("%s %s", m.other, m.filter))
+	}
+}
+
+func (s *LoadTopicSuite) TestSubscriptionFilters(c *C) {
+
+	topics := []replaceTopic{
+		{on: "$cloud/device/+/channel/+/reply", replace: "$cloud/device", with: "$device"},
+		{on: "$cloud/device/#", replace: "$cloud/device", with: "$device"},
+		{on: "$cloud/device/#", replace: "$cloud/device", with: "$device"},
+		{on: "$cloud/location/#", replace: "$cloud/location", with: "$location", share: "bridges"},
+		{on: "$cloud/location/calibration", replace: "$cloud/location", with: "$location"},
+	}
+
+	c.Assert(subscriptionFilters(topics, "cloud"), DeepEquals, []string{
+		"$cloud/device/#",
+		"$share/bridges/$cloud/location/#",
+		"$cloud/location/calibration",
+	})
+}
+
+func (s *LoadTopicSuite) TestOverlapFilters(c *C) {
+
+	overlaps := []struct {
+		a       string
+		b       string
+		overlap bool
+	}{
+		{"$device/+/channel/+", "$device/+/channel/+/reply", false},
+		{"$device/+/channel/+", "$device/a/+/b", true},
+		{"$device/#", "$device", true},
+		{"$device/a/#", "$device/b/#", false},
+		{"$device/+/x", "$device/y/+", true},
+		{"$device/+", "$device/+/+", false},
+	}
+
+	for _, m := range overlaps {
+		c.Check(overlapFilters(m.a, m.b), Equals, m.overlap, Commentf("%s %s", m.a, m.b))
+		c.Check(overlapFilters(m.b, m.a), Equals, m.overlap, Commentf("%s %s", m.b, m.a))
+	}
+
+	c.Assert(moreSpecific("$device/a/channel/+", "$device/+/channel/+"), Equals, true)
+	c.Assert(moreSpecific("$device/+/+", "$device/#"), Equals, true)
+	c.Assert(moreSpecific("$device", "$device/#"), Equals, true)
+	c.Assert(moreSpecific("$device/#", "$device/+"), Equals, false)
+}
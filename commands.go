@@ -23,6 +23,38 @@ func init() {
 			}, nil
 		},
 
+		"connect": func() (cli.Command, error) {
+			return &agent.ControlCommand{
+				Ui:     ui,
+				Action: "connect",
+			}, nil
+		},
+
+		"disconnect": func() (cli.Command, error) {
+			return &agent.ControlCommand{
+				Ui:     ui,
+				Action: "disconnect",
+			}, nil
+		},
+
+		"replay": func() (cli.Command, error) {
+			return &agent.ReplayCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"rules": func() (cli.Command, error) {
+			return &agent.RulesCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"status": func() (cli.Command, error) {
+			return &agent.StatusCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"version": func() (cli.Command, error) {
 			return &command.VersionCommand{
 				Version: Version,